@@ -1,26 +1,27 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"net/rpc"
 	"runtime"
 	"sync"
-	"time"
 
 	"github.com/comomac/kagami/core"
 )
 
-var (
-	sleepTime = time.Millisecond * 300
-)
-
-// Connect to Server RPC
-func Connect(serverIP string) error {
+// Connect to Server RPC, hashing images until the server has no more or ctx is cancelled
+func Connect(ctx context.Context, serverIP string) error {
 
 	client, err := rpc.Dial("tcp", serverIP+":"+core.RPCPort)
 	if err != nil {
 		return err
 	}
+	// closing the connection ends every thread
+	stop := context.AfterFunc(ctx, func() {
+		client.Close()
+	})
+	defer stop()
 
 	// start multi-threading
 	cpus := runtime.NumCPU()
@@ -38,6 +39,7 @@ func Connect(serverIP string) error {
 }
 
 func startThread(cpu int, client *rpc.Client, wg *sync.WaitGroup) error {
+	defer wg.Done()
 	fmt.Println("starting thread", cpu)
 	var err error
 
@@ -47,11 +49,6 @@ func startThread(cpu int, client *rpc.Client, wg *sync.WaitGroup) error {
 		if err != nil {
 			return err
 		}
-		// no data
-		if zipImg.Inode == 0 {
-			time.Sleep(sleepTime)
-			continue
-		}
 		if zipImg.Inode == -1 {
 			fmt.Println("no jobs")
 			break
@@ -60,23 +57,24 @@ func startThread(cpu int, client *rpc.Client, wg *sync.WaitGroup) error {
 		fmt.Printf("zipImg %d %9d %s\n", cpu, zipImg.DataSize, zipImg.Name)
 
 		var reply int
-		pHash, w, h, err := core.ProcessImage(zipImg.Data)
+		hshs, w, h, format, err := core.ProcessImage(zipImg.Data, zipImg.HashAlgos)
 		if err != nil {
 			zipImg.Error = true
 		} else {
 			zipImg.Parsed = true
-			zipImg.PHash = pHash
+			zipImg.Hashes = hshs
+			zipImg.Format = format
 			zipImg.Width = w
 			zipImg.Height = h
 		}
+		// no need to send image data back
+		zipImg.Data = nil
 		err = client.Call("Listener.SetZipImage", zipImg, &reply)
 		if err != nil {
 			return err
 		}
 	}
 
-	wg.Done()
-
 	fmt.Println("finishing thread", cpu)
 
 	return nil
@@ -0,0 +1,229 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sync"
+
+	"github.com/ninja-software/terror"
+)
+
+// pluggable archive readers, picked by magic bytes or file extension
+
+// magicLen bytes read from the start of file to detect archive format
+const magicLen = 512
+
+// ArchiveEntry individual image file read from an archive
+type ArchiveEntry struct {
+	Name  string // image file path+name
+	CRC32 uint32 // image data crc32
+	Size  uint64 // image data size
+	Data  []byte // image data
+}
+
+// ArchiveReader reads images out of an opened archive
+type ArchiveReader interface {
+	// Walk pass every image entry to fn in archive order.
+	// stops and returns the error if fn returns error
+	Walk(fn func(e *ArchiveEntry) error) error
+	// Close release the archive
+	Close() error
+}
+
+// entryLister optional ArchiveReader that lists image entries without reading image data.
+// entries have no Data, and must carry the same CRC32 and Size as Walk
+type entryLister interface {
+	List(fn func(e *ArchiveEntry) error) error
+}
+
+// ArchiveFormat describe how to detect and open an archive format
+type ArchiveFormat struct {
+	Name  string                                   // format name, e.g. cbz
+	Ext   *regexp.Regexp                           // file name match
+	Magic func(head []byte) bool                   // file head match, optional
+	Open  func(file string) (ArchiveReader, error) // open archive file
+}
+
+var (
+	archiveFormats    = []*ArchiveFormat{}
+	archiveFormatsMux sync.RWMutex
+)
+
+// RegisterArchiveFormat add archive format to the registry.
+// format registered later takes priority, so builtin formats can be overridden
+func RegisterArchiveFormat(af *ArchiveFormat) error {
+	if af == nil || af.Name == "" || af.Ext == nil || af.Open == nil {
+		return fmt.Errorf("archive format requires name, ext and open")
+	}
+
+	archiveFormatsMux.Lock()
+	archiveFormats = append([]*ArchiveFormat{af}, archiveFormats...)
+	archiveFormatsMux.Unlock()
+
+	return nil
+}
+
+// IsArchive check if file name matches a registered archive format
+func IsArchive(name string) bool {
+	return archiveFormatByExt(name) != nil
+}
+
+func archiveFormatByExt(name string) *ArchiveFormat {
+	archiveFormatsMux.RLock()
+	defer archiveFormatsMux.RUnlock()
+
+	for _, af := range archiveFormats {
+		if af.Ext.MatchString(name) {
+			return af
+		}
+	}
+
+	return nil
+}
+
+func archiveFormatByMagic(head []byte) *ArchiveFormat {
+	archiveFormatsMux.RLock()
+	defer archiveFormatsMux.RUnlock()
+
+	for _, af := range archiveFormats {
+		if af.Magic != nil && af.Magic(head) {
+			return af
+		}
+	}
+
+	return nil
+}
+
+// OpenArchive open archive with the reader matching its magic bytes,
+// falls back to file extension. image dir is opened as virtual archive
+func OpenArchive(file string) (ArchiveReader, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, terror.New(err, "")
+	}
+	if fi.IsDir() {
+		return openDir(file)
+	}
+
+	head, err := readHead(file)
+	if err != nil {
+		return nil, terror.New(err, "")
+	}
+
+	af := archiveFormatByMagic(head)
+	if af == nil {
+		af = archiveFormatByExt(file)
+	}
+	if af == nil {
+		return nil, fmt.Errorf("unsupported archive %s", file)
+	}
+
+	return af.Open(file)
+}
+
+// readHead read the first magicLen bytes of file
+func readHead(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	head := make([]byte, magicLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+
+	return head[:n], nil
+}
+
+// hasMagic returns magic matcher for bytes at offset
+func hasMagic(offset int, magic []byte) func(head []byte) bool {
+	return func(head []byte) bool {
+		if len(head) < offset+len(magic) {
+			return false
+		}
+		return bytes.Equal(head[offset:offset+len(magic)], magic)
+	}
+}
+
+// isImage check if file name is a supported image
+func isImage(name string) bool {
+	return reFileExtJPG.MatchString(name) ||
+		reFileExtPNG.MatchString(name) ||
+		reFileExtGIF.MatchString(name) ||
+		reFileExtWEBP.MatchString(name) ||
+		reFileExtBMP.MatchString(name) ||
+		reFileExtTIFF.MatchString(name)
+}
+
+// isImageDir check if dir is a leaf directory holding images
+func isImageDir(dir string) bool {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+
+	found := false
+	for _, fi := range fis {
+		if fi.IsDir() {
+			return false
+		}
+		if isImage(fi.Name()) {
+			found = true
+		}
+	}
+
+	return found
+}
+
+// isScanTarget check if walked file is an archive, or an image dir if imageDirs is set
+func isScanTarget(file string, info os.FileInfo, imageDirs bool) bool {
+	if info.IsDir() {
+		return imageDirs && isImageDir(file)
+	}
+
+	return IsArchive(info.Name())
+}
+
+// readArchive read every image in the archive in archive order and pass it to fn
+func readArchive(file string, fn func(e *ArchiveEntry) error) error {
+	r, err := OpenArchive(file)
+	if err != nil {
+		return terror.New(err, "")
+	}
+	defer r.Close()
+
+	return r.Walk(fn)
+}
+
+// listArchiveEntries list every image entry of archive without image data.
+// archives without index are read through, crc32 calculated from the data
+func listArchiveEntries(file string) ([]*ArchiveEntry, error) {
+	r, err := OpenArchive(file)
+	if err != nil {
+		return nil, terror.New(err, "")
+	}
+	defer r.Close()
+
+	entries := []*ArchiveEntry{}
+	collect := func(e *ArchiveEntry) error {
+		entries = append(entries, &ArchiveEntry{Name: e.Name, CRC32: e.CRC32, Size: e.Size})
+		return nil
+	}
+
+	if l, ok := r.(entryLister); ok {
+		err = l.List(collect)
+	} else {
+		err = r.Walk(collect)
+	}
+	if err != nil {
+		return nil, terror.New(err, "")
+	}
+	return entries, nil
+}
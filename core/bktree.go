@@ -0,0 +1,82 @@
+package core
+
+// bk-tree for hamming distance lookup of image hashes
+
+// bkTree metric tree of 64bit hashes by hamming distance
+type bkTree struct {
+	root *bkNode
+	size int // number of hashes added
+}
+
+type bkNode struct {
+	hash     uint64
+	items    []int // items added with this hash
+	children []bkChild
+}
+
+type bkChild struct {
+	dist int
+	node *bkNode
+}
+
+// Add hash with item
+func (t *bkTree) Add(hash uint64, item int) {
+	t.size++
+
+	if t.root == nil {
+		t.root = &bkNode{hash: hash, items: []int{item}}
+		return
+	}
+
+	node := t.root
+	for {
+		d := calcDist(node.hash, hash)
+		if d == 0 {
+			node.items = append(node.items, item)
+			return
+		}
+
+		var next *bkNode
+		for _, c := range node.children {
+			if c.dist == d {
+				next = c.node
+				break
+			}
+		}
+		if next == nil {
+			node.children = append(node.children, bkChild{
+				dist: d,
+				node: &bkNode{hash: hash, items: []int{item}},
+			})
+			return
+		}
+		node = next
+	}
+}
+
+// Find call fn for every item with hash within maxDist of hash
+func (t *bkTree) Find(hash uint64, maxDist int, fn func(item int)) {
+	if t.root == nil {
+		return
+	}
+
+	stack := []*bkNode{t.root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		d := calcDist(node.hash, hash)
+		if d <= maxDist {
+			for _, item := range node.items {
+				fn(item)
+			}
+		}
+
+		// triangle inequality, only children within d±maxDist can match
+		for _, c := range node.children {
+			if c.dist >= d-maxDist && c.dist <= d+maxDist {
+				stack = append(stack, c.node)
+			}
+		}
+	}
+}
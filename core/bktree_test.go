@@ -0,0 +1,137 @@
+package core
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// flipBits hash with n random bits flipped
+func flipBits(r *rand.Rand, hash uint64, n int) uint64 {
+	for _, b := range r.Perm(64)[:n] {
+		hash ^= 1 << uint(b)
+	}
+	return hash
+}
+
+// randomHashes hashes clustered around a few bases, so lookups at small distances find matches
+func randomHashes(r *rand.Rand, n int) []uint64 {
+	bases := make([]uint64, 8)
+	for i := range bases {
+		bases[i] = r.Uint64()
+	}
+	hashes := make([]uint64, n)
+	for i := range hashes {
+		hashes[i] = flipBits(r, bases[r.Intn(len(bases))], r.Intn(12))
+	}
+	return hashes
+}
+
+func TestBKTreeFindMatchesBruteForce(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	hashes := randomHashes(r, 2000)
+
+	tree := &bkTree{}
+	for i, h := range hashes {
+		tree.Add(h, i)
+	}
+
+	for _, maxDist := range []int{0, 1, 3, 5, 8, 12, 20} {
+		for q := 0; q < 50; q++ {
+			query := flipBits(r, hashes[r.Intn(len(hashes))], r.Intn(6))
+
+			got := []int{}
+			tree.Find(query, maxDist, func(item int) {
+				got = append(got, item)
+			})
+			sort.Ints(got)
+
+			want := []int{}
+			for i, h := range hashes {
+				if calcDist(h, query) <= maxDist {
+					want = append(want, i)
+				}
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("maxDist %d query %016x: tree found %d items, brute force %d", maxDist, query, len(got), len(want))
+			}
+		}
+	}
+}
+
+// testArchive archive of ahash pages
+func testArchive(ino int64, hashes []uint64) *Archive {
+	archive := &Archive{
+		Name:   "/lib/" + string(rune('a'+ino%26)) + ".cbz",
+		Dev:    1,
+		Inode:  ino,
+		Hashes: []string{HashAverage},
+	}
+	for i, h := range hashes {
+		archive.Images = append(archive.Images, &ZipImage{
+			Nth:    i,
+			Name:   string(rune('a'+i)) + ".png",
+			Hashes: map[string]uint64{HashAverage: h},
+		})
+	}
+	return archive
+}
+
+// bruteSimilarMatch similar match comparing head with every archive, without index
+func bruteSimilarMatch(head *Archive, archives Archives) []int {
+	dups := []int{}
+	if len(head.Images) <= 5 {
+		return dups
+	}
+	imgHeads := similarImages(head, true)
+	for i, archive := range archives {
+		if archive.Inode == 0 || archive.id() == head.id() || !archive.hasHash(hashAlgo) || len(archive.Images) <= 5 {
+			continue
+		}
+		if len(head.Images)-len(archive.Images) > maxArchiveLengthDiff || len(archive.Images)-len(head.Images) > maxArchiveLengthDiff {
+			continue
+		}
+		if similarScore(imgHeads, archive) >= minScore {
+			dups = append(dups, i)
+		}
+	}
+	return dups
+}
+
+func TestFindSimilarMatchMatchesBruteForce(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+
+	// archives sharing noisy copies of a few page sets
+	sets := make([][]uint64, 5)
+	for i := range sets {
+		sets[i] = randomHashes(r, 12)
+	}
+	archives := Archives{}
+	for i := 0; i < 80; i++ {
+		pages := []uint64{}
+		for _, h := range sets[r.Intn(len(sets))][:6+r.Intn(6)] {
+			pages = append(pages, flipBits(r, h, r.Intn(5)))
+		}
+		archives = append(archives, testArchive(int64(i+1), pages))
+	}
+
+	matched := 0
+	for _, maxDist := range []int{0, 1, 2, 3, 5, 8} {
+		setCheckOptions(CheckOptions{MaxImageDist: maxDist, MaxArchiveDiff: 10, HashAlgo: HashAverage})
+		index := buildSimilarIndex(archives)
+
+		for _, head := range archives {
+			got := findSimilarMatch(head, archives, index)
+			want := bruteSimilarMatch(head, archives)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("maxDist %d head %d: index matched %v, brute force %v", maxDist, head.Inode, got, want)
+			}
+			matched += len(want)
+		}
+	}
+	if matched == 0 {
+		t.Fatal("no archive matched, test data too far apart")
+	}
+}
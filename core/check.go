@@ -2,16 +2,17 @@ package core
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
 	"math/bits"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/davecgh/go-spew/spew"
 	"github.com/ninja-software/terror"
 )
 
@@ -19,11 +20,15 @@ import (
 
 // Archive holds the images
 type Archive struct {
-	Name   string      // full zip file path
-	MTime  time.Time   // zip file modified time
-	Inode  int64       // zip file inode
-	Images []*ZipImage // metadata for images
-	Exact  bool        // exact match to head archive
+	Name        string      // full zip file path
+	MTime       time.Time   // zip file modified time
+	Size        int64       // zip file size
+	Dev         uint64      // zip file device
+	Inode       int64       // zip file inode
+	Fingerprint string      // content identity, see fingerprint
+	Hashes      []string    // image hash algorithms of the images
+	Images      []*ZipImage // metadata for images
+	Exact       bool        // exact match to head archive
 }
 
 // Archives list of image archives
@@ -31,16 +36,13 @@ type Archives []*Archive
 
 // DupArchive duplicate archive
 type DupArchive struct {
-	Head *Archive
-	Dups []*Archive
+	Head *Archive   // archive to keep
+	Dups []*Archive // duplicates of head
 }
 
 // DupArchives list of duplicate archives
 type DupArchives []*DupArchive
 
-// DupInodeMap maps the inode with duplicate flag
-type DupInodeMap map[int64]bool
-
 // adjustable
 var (
 	// match image by exact match
@@ -51,8 +53,58 @@ var (
 	minScore = 4
 	// maximum acceptable images length between archive
 	maxArchiveLengthDiff = 10
+	// image hash algorithm for similar match
+	hashAlgo = HashAverage
+	// second image hash algorithm that must also match, optional
+	agreeHashAlgo = ""
+	// how matching archives are grouped
+	grouping = GroupSingle
+)
+
+// duplicate archive grouping
+const (
+	GroupSingle   = "single"   // transitive, archives matching any group member join the group
+	GroupComplete = "complete" // every group member matches every other member
 )
 
+// CheckOptions options for finding duplicate archives
+type CheckOptions struct {
+	MaxImageDist   int        // maximum acceptable image distance, 0-64
+	MaxArchiveDiff int        // maximum acceptable images length between archive
+	ExactMatch     bool       // match image by exact match
+	HashAlgo       string     // image hash algorithm for similar match, HashAverage if empty
+	AgreeHashAlgo  string     // second image hash algorithm that must also match, optional
+	Grouping       string     // GroupSingle or GroupComplete, GroupSingle if empty
+	KeepPolicy     KeepPolicy // picks the head of each group, first by path if empty
+	Format         string     // check result format, FormatText if empty
+}
+
+// id file identity of archive
+func (archive *Archive) id() fileID {
+	return fileID{Dev: archive.Dev, Ino: uint64(archive.Inode)}
+}
+
+// hasHash check if archive images have hash of algo
+func (archive *Archive) hasHash(algo string) bool {
+	for _, a := range archive.Hashes {
+		if a == algo {
+			return true
+		}
+	}
+	return false
+}
+
+// imageMatch check if images are similar by hashAlgo, and by agreeHashAlgo if set
+func imageMatch(a, b *ZipImage) bool {
+	if calcDist(a.Hashes[hashAlgo], b.Hashes[hashAlgo]) > maxImageDist {
+		return false
+	}
+	if agreeHashAlgo != "" && calcDist(a.Hashes[agreeHashAlgo], b.Hashes[agreeHashAlgo]) > maxImageDist {
+		return false
+	}
+	return true
+}
+
 func loadSums(dir string) (Archives, error) {
 	archives := Archives{}
 
@@ -72,7 +124,7 @@ func loadSums(dir string) (Archives, error) {
 
 		archive, err := loadSum(file)
 		if err != nil {
-			fmt.Println("err loadSum", file)
+			fmt.Println("err loadSum", file, err)
 			return nil
 		}
 		if archive.Inode == 0 {
@@ -105,41 +157,45 @@ func loadSum(file string) (*Archive, error) {
 	}
 
 	archive := &Archive{
-		Inode: int64(ino),
+		Inode:  int64(ino),
+		Hashes: []string{HashAverage},
 	}
 
+	version := 1
 	imageNth := 0
-	for _, line := range lines {
+	for n, line := range lines {
 		line2 := strings.TrimSpace(line)
+		if line2 == "" {
+			continue
+		}
 		if strings.HasPrefix(line2, "#") {
+			// find out record version
+			if strings.HasPrefix(line2, "# kagami_imgsum_ver: ") {
+				version, err = strconv.Atoi(strings.ReplaceAll(line2, "# kagami_imgsum_ver: ", ""))
+				if err != nil {
+					return nil, terror.New(err, "")
+				}
+			}
 			// find out archive file name
 			if strings.HasPrefix(line2, "# file: ") {
 				archive.Name = strings.ReplaceAll(line2, "# file: ", "")
 			}
+			// find out image hash algorithm
+			if strings.HasPrefix(line2, "# hash: ") {
+				archive.Hashes = strings.Fields(strings.ReplaceAll(line2, "# hash: ", ""))
+			}
 			continue
 		}
 
-		// make sure line has at least 80 chars
-		if len(line) < 80 {
-			continue
-		}
-
-		left := line[0:77]
-		right := line[80:]
-
-		zz := ZipImage{
-			Name: right,
-			Nth:  imageNth,
-		}
-		_, err := fmt.Sscanf(left, "%8X %16X %d %d %d %16X", &zz.CRC32, &zz.MD5, &zz.DataSize, &zz.Width, &zz.Height, &zz.PHash)
+		zz, err := parseSumLine(line, version, archive.Hashes)
 		if err != nil {
-			fmt.Println("err", err, file)
-			spew.Dump(left)
-			continue
+			return nil, fmt.Errorf("line %d: %w", n+1, err)
 		}
+		zz.Nth = imageNth
+		zz.HashAlgos = archive.Hashes
 		imageNth++
 
-		archive.Images = append(archive.Images, &zz)
+		archive.Images = append(archive.Images, zz)
 	}
 
 	return archive, nil
@@ -152,49 +208,84 @@ func calcDist(a, b uint64) int {
 	return bits.OnesCount64(c)
 }
 
-func findDup(archives Archives) {
-	// file inodes that been found to be dup
-	dupInodeMap := DupInodeMap{}
+// findDup group archives with duplicate images.
+// groups do not depend on archives order
+func findDup(archives Archives) DupArchives {
+	// fixed order, so results do not depend on load order
+	archives = append(Archives{}, archives...)
+	sort.SliceStable(archives, func(i, j int) bool {
+		if archives[i].Name != archives[j].Name {
+			return archives[i].Name < archives[j].Name
+		}
+		if archives[i].Dev != archives[j].Dev {
+			return archives[i].Dev < archives[j].Dev
+		}
+		return archives[i].Inode < archives[j].Inode
+	})
 
-	// detected dup groups
-	groups := DupArchives{}
+	// image content index for exact match, hamming index for similar match
+	var exIndex exactIndex
+	var index *bkTree
+	if exactMatch {
+		exIndex = buildExactIndex(archives)
+	} else {
+		index = buildSimilarIndex(archives)
+	}
 
-	for _, head := range archives {
-		// fmt.Println("scan", archive.Name)
+	// link every matching archive pair, either direction
+	uf := newUnionFind(len(archives))
+	links := map[[2]int]bool{}
+	for i, head := range archives {
 		// skip invalid
 		if head.Inode == 0 {
 			continue
 		}
-		// skip already found dup
-		if dupInodeMap[head.Inode] {
-			continue
-		}
-
-		dups := []*Archive{}
 
+		matches := []int{}
 		if exactMatch {
 			// find by exact image match archive
-			dups = findExactMatch(head, archives, dupInodeMap)
+			matches = findExactMatch(head, archives, exIndex)
 		} else {
 			// find by similar image match archive
-			dups = findSimilarMatch(head, archives, dupInodeMap)
+			matches = findSimilarMatch(head, archives, index)
 		}
 
-		// skip no duplicate found
-		if len(dups) == 0 {
-			continue
+		for _, j := range matches {
+			uf.Union(i, j)
+			links[pairKey(i, j)] = true
 		}
+	}
 
-		// holds the dup and the head
-		dup := &DupArchive{
-			Head: head,
-			Dups: dups,
+	clusters := [][]int{}
+	for _, group := range uf.Groups() {
+		if grouping == GroupComplete {
+			clusters = append(clusters, completeLink(group, links)...)
+		} else {
+			clusters = append(clusters, group)
 		}
+	}
 
+	// detected dup groups, first member is the head
+	groups := DupArchives{}
+	for _, cluster := range clusters {
+		dup := &DupArchive{
+			Head: archives[cluster[0]],
+		}
+		for _, i := range cluster[1:] {
+			dup.Dups = append(dup.Dups, archives[i])
+		}
 		groups = append(groups, dup)
-		fmt.Printf("%d: (%d) %s\n", len(groups), head.Inode, head.Name)
+	}
+
+	return groups
+}
+
+// printDups print duplicate groups
+func printDups(groups DupArchives) {
+	for n, dup := range groups {
+		fmt.Printf("%d: keep (%s) %s\n", n+1, dup.Head.id(), dup.Head.Name)
 		for i, d := range dup.Dups {
-			fmt.Printf("  > %d (%d) %s\n", i, d.Inode, d.Name)
+			fmt.Printf("  > %d (%s) %s\n", i, d.id(), d.Name)
 		}
 		fmt.Printf("\n\n")
 	}
@@ -202,73 +293,177 @@ func findDup(archives Archives) {
 	fmt.Printf("found %d dup groups\n", len(groups))
 }
 
-// todo fix bug for this function, every now and then it just grab too many not dup
-func findExactMatch(head *Archive, archives Archives, dupInodeMap DupInodeMap) []*Archive {
-	dups := []*Archive{}
+// pageKey identity of image content for exact match
+type pageKey struct {
+	CRC32 uint32
+	MD5   [16]byte
+	Size  uint64
+}
 
-	// loop all other archives to find
-	for _, archive := range archives {
-		// skip invalid
+// exactIndex archive positions holding each image content, one entry per image
+type exactIndex map[pageKey][]int
+
+// buildExactIndex index image contents by archive position
+func buildExactIndex(archives Archives) exactIndex {
+	index := exactIndex{}
+	for i, archive := range archives {
 		if archive.Inode == 0 {
 			continue
 		}
-		// skip itself
-		if archive.Inode == head.Inode {
+		for _, image := range archive.Images {
+			key := pageKey{CRC32: image.CRC32, MD5: image.MD5, Size: image.DataSize}
+			index[key] = append(index[key], i)
+		}
+	}
+	return index
+}
+
+// sharedImages count images head shares with every other archive by position.
+// images are counted as multiset, so repeated image is not counted more than it appears in both
+func (index exactIndex) sharedImages(head *Archive) map[int]int {
+	headCounts := map[pageKey]int{}
+	for _, image := range head.Images {
+		headCounts[pageKey{CRC32: image.CRC32, MD5: image.MD5, Size: image.DataSize}]++
+	}
+
+	shared := map[int]int{}
+	for key, headCount := range headCounts {
+		counts := map[int]int{}
+		for _, i := range index[key] {
+			counts[i]++
+		}
+		for i, count := range counts {
+			if count < headCount {
+				shared[i] += count
+			} else {
+				shared[i] += headCount
+			}
+		}
+	}
+	return shared
+}
+
+// findExactMatch positions of archives sharing enough identical images with head
+func findExactMatch(head *Archive, archives Archives, index exactIndex) []int {
+	dups := []int{}
+
+	// candidate archives sharing at least one image, in archives order
+	shared := index.sharedImages(head)
+	candidates := []int{}
+	for i := range shared {
+		candidates = append(candidates, i)
+	}
+	sort.Ints(candidates)
+
+	// loop candidate archives to find
+	for _, i := range candidates {
+		archive := archives[i]
+
+		// skip invalid
+		if archive.Inode == 0 {
 			continue
 		}
-		// skip if already mark as dup
-		if dupInodeMap[archive.Inode] {
+		// skip itself, same inode on another device is a different archive
+		if archive.id() == head.id() {
 			continue
 		}
 		// skip if image length too different
 		if math.Abs(float64(len(head.Images)-len(archive.Images))) > float64(maxArchiveLengthDiff) {
 			continue
 		}
+		// skip if too many images not shared
+		if len(head.Images)-shared[i] > maxArchiveLengthDiff {
+			continue
+		}
+		// skip if shared images are not most of the larger archive, e.g. only a credits page
+		if shared[i]*2 <= max(len(head.Images), len(archive.Images)) {
+			continue
+		}
 
-		found := 0
-		for _, headImage := range head.Images {
-			for _, image := range archive.Images {
-				if image.CRC32 == headImage.CRC32 &&
-					image.DataSize == headImage.DataSize &&
-					image.Height == headImage.Height &&
-					image.Width == headImage.Width {
-					found++
-				}
+		dups = append(dups, i)
+	}
+
+	return dups
+}
+
+// similarImages images of archive compared in similar match.
+// head uses the first 5 non blank images, others use the first 11 images
+func similarImages(archive *Archive, head bool) []*ZipImage {
+	imgs := []*ZipImage{}
+	for _, image := range archive.Images {
+		if head {
+			// no blank page, all 0s
+			if image.Hashes[hashAlgo] == 0 {
+				continue
+			}
+			// need only 5
+			if len(imgs) >= 5 {
+				break
 			}
+		} else if len(imgs) > 10 {
+			// dont go too far to save cpu cycle
+			break
 		}
-		if len(head.Images)-found > maxArchiveLengthDiff {
+
+		imgs = append(imgs, image)
+	}
+	return imgs
+}
+
+// buildSimilarIndex index image hashes compared in similar match by archive position
+func buildSimilarIndex(archives Archives) *bkTree {
+	index := &bkTree{}
+	for i, archive := range archives {
+		// skip archives similar match never compares
+		if archive.Inode == 0 || len(archive.Images) <= 5 || !archive.hasHash(hashAlgo) {
 			continue
 		}
+		for _, image := range similarImages(archive, false) {
+			index.Add(image.Hashes[hashAlgo], i)
+		}
+	}
+	return index
+}
 
-		dups = append(dups, archive)
+// findSimilarMatch positions of archives with enough images similar to head
+func findSimilarMatch(head *Archive, archives Archives, index *bkTree) []int {
+	dups := []int{}
 
-		// set dup flag
-		dupInodeMap[archive.Inode] = true
-		dupInodeMap[head.Inode] = true
+	// skip if no enough images to compare
+	if len(head.Images) <= 5 {
+		return dups
 	}
 
-	return dups
-}
+	// matching image hashes for similar match
+	imgHeads := similarImages(head, true)
 
-func findSimilarMatch(head *Archive, archives Archives, dupInodeMap DupInodeMap) []*Archive {
-	dups := []*Archive{}
+	// candidate archives holding at least one similar image, in archives order
+	candidateMap := map[int]bool{}
+	for _, imgHead := range imgHeads {
+		index.Find(imgHead.Hashes[hashAlgo], maxImageDist, func(i int) {
+			candidateMap[i] = true
+		})
+	}
+	candidates := []int{}
+	for i := range candidateMap {
+		candidates = append(candidates, i)
+	}
+	sort.Ints(candidates)
+
+	// loop candidate archives to find
+	for _, i := range candidates {
+		archive := archives[i]
 
-	// loop all other archives to find
-	for _, archive := range archives {
 		// skip invalid
 		if archive.Inode == 0 {
 			continue
 		}
-		// skip itself
-		if archive.Inode == head.Inode {
-			continue
-		}
-		// skip if already mark as dup
-		if dupInodeMap[archive.Inode] {
+		// skip itself, same inode on another device is a different archive
+		if archive.id() == head.id() {
 			continue
 		}
-		// skip if no enough images to compare
-		if len(head.Images) <= 5 {
+		// skip if not hashed by required algorithm
+		if !archive.hasHash(hashAlgo) || (agreeHashAlgo != "" && !archive.hasHash(agreeHashAlgo)) {
 			continue
 		}
 		// skip if no enough images to compare (b)
@@ -280,70 +475,101 @@ func findSimilarMatch(head *Archive, archives Archives, dupInodeMap DupInodeMap)
 			continue
 		}
 
-		// matching pHashes for similar match
-		imgHeads := []uint64{}
-		for i := 0; i < len(head.Images); i++ {
-			// no blank page, all 0s
-			if head.Images[i].PHash == 0 {
-				continue
-			}
-			// need only 5
-			if len(imgHeads) >= 5 {
-				break
-			}
-
-			imgHeads = append(imgHeads, head.Images[i].PHash)
+		// at least find x dup image before classify as dup archive
+		if similarScore(imgHeads, archive) >= minScore {
+			dups = append(dups, i)
 		}
+	}
 
-		// score for keeping how many pHash match consecutive
-		score := 0
-		for i, image := range archive.Images {
-			// dont go too far to save cpu cycle
-			if i > 10 {
-				break
-			}
-			// find dup
-			for _, imgHead := range imgHeads {
-				if calcDist(imgHead, image.PHash) <= maxImageDist {
-					score++
-				}
+	return dups
+}
+
+// similarScore count similar image pairs between head images and the compared images of archive
+func similarScore(imgHeads []*ZipImage, archive *Archive) int {
+	// score for keeping how many pHash match consecutive
+	score := 0
+	for _, image := range similarImages(archive, false) {
+		// find dup
+		for _, imgHead := range imgHeads {
+			if imageMatch(imgHead, image) {
+				score++
 			}
 		}
+	}
+	return score
+}
 
-		// at least find x dup image before classify as dup archive
-		if score >= minScore {
-			dups = append(dups, archive)
+// setCheckOptions set adjustable match options
+func setCheckOptions(opts CheckOptions) {
+	maxImageDist = opts.MaxImageDist
+	maxArchiveLengthDiff = opts.MaxArchiveDiff
+	exactMatch = opts.ExactMatch
+	hashAlgo = opts.HashAlgo
+	if hashAlgo == "" {
+		hashAlgo = HashAverage
+	}
+	agreeHashAlgo = opts.AgreeHashAlgo
+	grouping = opts.Grouping
+	if grouping == "" {
+		grouping = GroupSingle
+	}
+}
 
-			// set dup flag
-			dupInodeMap[archive.Inode] = true
-			dupInodeMap[head.Inode] = true
+// warnMissingHashes warn about archives similar match skips for lacking the hash or agree hash
+func warnMissingHashes(archives Archives, w io.Writer) {
+	if exactMatch {
+		return
+	}
+	for _, algo := range []string{hashAlgo, agreeHashAlgo} {
+		if algo == "" {
+			continue
+		}
+		missing := 0
+		for _, archive := range archives {
+			if archive.Inode != 0 && !archive.hasHash(algo) {
+				missing++
+			}
+		}
+		if missing > 0 {
+			fmt.Fprintf(w, "warning: %d archives lack %s and are skipped, rescan with -hash including %s\n", missing, algo, algo)
 		}
 	}
-
-	return dups
 }
 
-func rmDup() {
+// loadDups load image sums from store dir and find duplicate archive groups
+func loadDups(dir string, opts CheckOptions) (DupArchives, error) {
+	archives, err := loadStore(dir, opts.StatusOut())
+	if err != nil {
+		return nil, terror.New(err, "")
+	}
 
-}
+	setCheckOptions(opts)
 
-func hostUI() {
+	fmt.Fprintf(opts.StatusOut(), "found %d archives\n", len(archives))
+	warnMissingHashes(archives, opts.StatusOut())
 
+	groups := findDup(archives)
+	for _, dup := range groups {
+		opts.KeepPolicy.selectKeeper(dup)
+	}
+
+	return groups, nil
 }
 
 // FindDup exec find duplicate archive
-func FindDup(dir string, maxIDiff, maxADiff int, exMatch bool) error {
-	archives, err := loadSums(dir)
+func FindDup(dir string, opts CheckOptions) error {
+	groups, err := loadDups(dir, opts)
 	if err != nil {
 		return terror.New(err, "")
 	}
 
-	maxImageDist = maxIDiff
-	maxArchiveLengthDiff = maxADiff
-	exactMatch = exMatch
-
-	fmt.Printf("found %d txt\n", len(archives))
+	switch opts.Format {
+	case FormatJSON:
+		return writeDupsJSON(os.Stdout, groups)
+	case FormatCSV:
+		return writeDupsCSV(os.Stdout, groups)
+	}
 
-	findDup(archives)
+	printDups(groups)
 	return nil
 }
@@ -0,0 +1,63 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// exactArchive archive whose pages are the given crc32s
+func exactArchive(ino int64, crcs ...uint32) *Archive {
+	archive := &Archive{Dev: 1, Inode: ino}
+	for i, crc := range crcs {
+		archive.Images = append(archive.Images, &ZipImage{
+			Nth:      i,
+			CRC32:    crc,
+			MD5:      [16]byte{byte(crc)},
+			DataSize: uint64(crc) * 100,
+		})
+	}
+	return archive
+}
+
+func TestSharedImagesCountsRepeatedPagesAsMultiset(t *testing.T) {
+	head := exactArchive(1, 1, 1, 2)
+	archives := Archives{
+		head,
+		exactArchive(2, 1, 2, 2), // one 1 and one 2 shared
+		exactArchive(3, 1, 1, 1), // both 1s shared, not three
+		exactArchive(4, 3),       // nothing shared
+		exactArchive(5, 2, 1, 1), // same pages in another order
+	}
+
+	got := buildExactIndex(archives).sharedImages(head)
+	want := map[int]int{0: 3, 1: 2, 2: 2, 4: 3}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("shared images %v, want %v", got, want)
+	}
+}
+
+func TestFindDupExactNeedsMostPagesShared(t *testing.T) {
+	// chapters of 8 different pages sharing only a credits page
+	archives := Archives{}
+	for ch := 1; ch <= 5; ch++ {
+		crcs := []uint32{}
+		for p := 0; p < 7; p++ {
+			crcs = append(crcs, uint32(ch*100+p))
+		}
+		archive := exactArchive(int64(ch), append(crcs, 999)...)
+		archive.Name = fmt.Sprintf("/lib/ch%02d.cbz", ch)
+		archives = append(archives, archive)
+	}
+	// copy of chapter 1 with an extra page is still a dup
+	copied := exactArchive(6, 100, 101, 102, 103, 104, 105, 106, 999, 998)
+	copied.Name = "/lib/ch01 copy.cbz"
+	archives = append(archives, copied)
+
+	setCheckOptions(CheckOptions{MaxArchiveDiff: 10, ExactMatch: true, Grouping: GroupComplete})
+	got := groupNames(findDup(archives))
+	want := [][]string{{"/lib/ch01 copy.cbz", "/lib/ch01.cbz"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("groups %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,218 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"github.com/ninja-software/terror"
+)
+
+// page by page comparison of two archives
+
+// PagePair aligned pages of two archives, A or B is nil if the page is only in the other archive
+type PagePair struct {
+	A    *ZipImage
+	B    *ZipImage
+	NA   int // page number in A, 1 based, 0 if none
+	NB   int // page number in B, 1 based, 0 if none
+	Dist int // hamming distance of matched pages by hashAlgo
+}
+
+// Matched check if both archives have the page
+func (p *PagePair) Matched() bool {
+	return p.A != nil && p.B != nil
+}
+
+// ResolutionDiffer check if matched pages have different resolution
+func (p *PagePair) ResolutionDiffer() bool {
+	return p.Matched() && (p.A.Width != p.B.Width || p.A.Height != p.B.Height)
+}
+
+// ArchiveCompare pages of two archives aligned in page order
+type ArchiveCompare struct {
+	A     *Archive
+	B     *Archive
+	Pairs []*PagePair
+
+	Matched    int // pages in both archives
+	Resolution int // matched pages with different resolution
+	OnlyA      int // pages only in A
+	OnlyB      int // pages only in B
+}
+
+// alignScore alignment of remaining pages, more matches then smaller total distance is better
+type alignScore struct {
+	matches int
+	dist    int
+}
+
+func (s alignScore) better(o alignScore) bool {
+	if s.matches != o.matches {
+		return s.matches > o.matches
+	}
+	return s.dist < o.dist
+}
+
+// pageMatch check if pages are the same image, by content on exactMatch, otherwise by imageMatch
+func pageMatch(a, b *ZipImage) bool {
+	if exactMatch {
+		return a.CRC32 == b.CRC32 && a.MD5 == b.MD5 && a.DataSize == b.DataSize
+	}
+	return imageMatch(a, b)
+}
+
+// compareArchives align pages of a and b in page order, matching the most pages with the least distance
+func compareArchives(a, b *Archive) *ArchiveCompare {
+	n, m := len(a.Images), len(b.Images)
+
+	// matched alignment score of page i and j, ok false if pages do not match
+	matchScore := func(best [][]alignScore, i, j int) (alignScore, bool) {
+		if !pageMatch(a.Images[i], b.Images[j]) {
+			return alignScore{}, false
+		}
+		d := calcDist(a.Images[i].Hashes[hashAlgo], b.Images[j].Hashes[hashAlgo])
+		return alignScore{best[i+1][j+1].matches + 1, best[i+1][j+1].dist + d}, true
+	}
+
+	// best[i][j] best alignment of a.Images[i:] and b.Images[j:]
+	best := make([][]alignScore, n+1)
+	for i := range best {
+		best[i] = make([]alignScore, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			s := best[i+1][j]
+			if best[i][j+1].better(s) {
+				s = best[i][j+1]
+			}
+			if ms, ok := matchScore(best, i, j); ok && ms.better(s) {
+				s = ms
+			}
+			best[i][j] = s
+		}
+	}
+
+	cmp := &ArchiveCompare{A: a, B: b}
+	i, j := 0, 0
+	for i < n || j < m {
+		matched := false
+		if i < n && j < m {
+			ms, ok := matchScore(best, i, j)
+			matched = ok && best[i][j] == ms
+		}
+
+		switch {
+		case matched:
+			p := &PagePair{
+				A:    a.Images[i],
+				B:    b.Images[j],
+				NA:   i + 1,
+				NB:   j + 1,
+				Dist: calcDist(a.Images[i].Hashes[hashAlgo], b.Images[j].Hashes[hashAlgo]),
+			}
+			cmp.Pairs = append(cmp.Pairs, p)
+			cmp.Matched++
+			if p.ResolutionDiffer() {
+				cmp.Resolution++
+			}
+			i++
+			j++
+		case i < n && (j == m || best[i][j] == best[i+1][j]):
+			cmp.Pairs = append(cmp.Pairs, &PagePair{A: a.Images[i], NA: i + 1})
+			cmp.OnlyA++
+			i++
+		default:
+			cmp.Pairs = append(cmp.Pairs, &PagePair{B: b.Images[j], NB: j + 1})
+			cmp.OnlyB++
+			j++
+		}
+	}
+
+	return cmp
+}
+
+// findArchive find archive by device:inode, inode or path
+func findArchive(archives Archives, ref string) *Archive {
+	for _, archive := range archives {
+		if archive.id().String() == ref {
+			return archive
+		}
+	}
+
+	ino, err := strconv.ParseInt(ref, 10, 64)
+	if err == nil {
+		for _, archive := range archives {
+			if archive.Inode == ino {
+				return archive
+			}
+		}
+	}
+
+	abs, _ := filepath.Abs(ref)
+	for _, archive := range archives {
+		if archive.Name == ref || archive.Name == abs {
+			return archive
+		}
+	}
+	return nil
+}
+
+// loadCompare load image sums from store dir and compare archives a and b, given by device:inode, inode or path
+func loadCompare(dir, a, b string, opts CheckOptions) (*ArchiveCompare, error) {
+	archives, err := loadStore(dir, opts.StatusOut())
+	if err != nil {
+		return nil, terror.New(err, "")
+	}
+
+	setCheckOptions(opts)
+
+	archiveA := findArchive(archives, a)
+	if archiveA == nil {
+		return nil, fmt.Errorf("archive not found %s", a)
+	}
+	archiveB := findArchive(archives, b)
+	if archiveB == nil {
+		return nil, fmt.Errorf("archive not found %s", b)
+	}
+	for _, archive := range []*Archive{archiveA, archiveB} {
+		if !exactMatch && (!archive.hasHash(hashAlgo) || (agreeHashAlgo != "" && !archive.hasHash(agreeHashAlgo))) {
+			return nil, fmt.Errorf("archive has no required hash %s", archive.Name)
+		}
+	}
+
+	return compareArchives(archiveA, archiveB), nil
+}
+
+// CompareArchives print page by page comparison of archives a and b, given by device:inode, inode or path
+func CompareArchives(dir, a, b string, opts CheckOptions) error {
+	cmp, err := loadCompare(dir, a, b, opts)
+	if err != nil {
+		return terror.New(err, "")
+	}
+
+	printCompare(cmp)
+	return nil
+}
+
+func printCompare(cmp *ArchiveCompare) {
+	fmt.Printf("A: (%s) %s, %d pages\n", cmp.A.id(), cmp.A.Name, len(cmp.A.Images))
+	fmt.Printf("B: (%s) %s, %d pages\n", cmp.B.id(), cmp.B.Name, len(cmp.B.Images))
+
+	for _, p := range cmp.Pairs {
+		switch {
+		case p.ResolutionDiffer():
+			fmt.Printf("  ! A %4d %s %dx%d  B %4d %s %dx%d  dist %d, resolution differs\n",
+				p.NA, p.A.Name, p.A.Width, p.A.Height, p.NB, p.B.Name, p.B.Width, p.B.Height, p.Dist)
+		case p.Matched():
+			fmt.Printf("  = A %4d %s  B %4d %s  dist %d\n", p.NA, p.A.Name, p.NB, p.B.Name, p.Dist)
+		case p.A != nil:
+			fmt.Printf("  < A %4d %s  only in A\n", p.NA, p.A.Name)
+		default:
+			fmt.Printf("  > B %4d %s  only in B\n", p.NB, p.B.Name)
+		}
+	}
+
+	fmt.Printf("matched %d, resolution differs %d, only in A %d, only in B %d\n",
+		cmp.Matched, cmp.Resolution, cmp.OnlyA, cmp.OnlyB)
+}
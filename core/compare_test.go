@@ -0,0 +1,119 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// storeWith store dir holding archives
+func storeWith(t *testing.T, archives ...*Archive) string {
+	dir := t.TempDir()
+	st, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	for _, archive := range archives {
+		if err := st.PutArchive(archive); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadCompareHashRequirement(t *testing.T) {
+	a := testArchive(1, []uint64{1, 2, 3})
+	b := testArchive(2, []uint64{1, 2, 4})
+	dir := storeWith(t, a, b)
+
+	// exact match compares page content, hashes are not needed
+	_, err := loadCompare(dir, "1:1", "1:2", CheckOptions{ExactMatch: true, HashAlgo: HashAverage, AgreeHashAlgo: HashDifference})
+	if err != nil {
+		t.Errorf("exact compare: %v", err)
+	}
+
+	_, err = loadCompare(dir, "1:1", "1:2", CheckOptions{HashAlgo: HashAverage, AgreeHashAlgo: HashDifference})
+	if err == nil {
+		t.Error("similar compare without agree hash accepted")
+	}
+	_, err = loadCompare(dir, "1:1", "1:2", CheckOptions{HashAlgo: HashDifference})
+	if err == nil {
+		t.Error("similar compare without hash accepted")
+	}
+	_, err = loadCompare(dir, "1:1", "1:2", CheckOptions{HashAlgo: HashAverage})
+	if err != nil {
+		t.Errorf("similar compare: %v", err)
+	}
+}
+
+// pairLayout pairs as "a-b" page numbers, blank for a missing page
+func pairLayout(cmp *ArchiveCompare) string {
+	pairs := []string{}
+	for _, p := range cmp.Pairs {
+		na, nb := "", ""
+		if p.NA > 0 {
+			na = fmt.Sprint(p.NA)
+		}
+		if p.NB > 0 {
+			nb = fmt.Sprint(p.NB)
+		}
+		pairs = append(pairs, na+"-"+nb)
+	}
+	return strings.Join(pairs, " ")
+}
+
+func TestCompareArchivesAlignment(t *testing.T) {
+	const p, q, r = 0x0, 0xffffffff, 0xffffffff00000000
+
+	tests := []struct {
+		name   string
+		a, b   []uint64
+		layout string
+		dist   int
+	}{
+		{"same pages", []uint64{p, q, r}, []uint64{p, q, r}, "1-1 2-2 3-3", 0},
+		{"page inserted", []uint64{p, q, r}, []uint64{p, 0x5555, q, r}, "1-1 -2 2-3 3-4", 0},
+		{"cover missing", []uint64{r, p, q}, []uint64{p, q}, "1- 2-1 3-2", 0},
+		{"closest page matched", []uint64{p}, []uint64{p ^ 0x3, p ^ 0x1}, "-1 1-2", 1},
+		{"more pages over less distance", []uint64{p, q}, []uint64{q, p ^ 0x7, q ^ 0x7}, "-1 1-2 2-3", 6},
+		{"pages swapped", []uint64{p, q}, []uint64{q, p}, "1- 2-1 -2", 0},
+		{"nothing shared", []uint64{p}, []uint64{q}, "1- -1", 0},
+	}
+
+	setCheckOptions(CheckOptions{MaxImageDist: 3, MaxArchiveDiff: 10, HashAlgo: HashAverage})
+	for _, tt := range tests {
+		cmp := compareArchives(testArchive(1, tt.a), testArchive(2, tt.b))
+		if got := pairLayout(cmp); got != tt.layout {
+			t.Errorf("%s: layout %q, want %q", tt.name, got, tt.layout)
+		}
+
+		dist := 0
+		for _, pair := range cmp.Pairs {
+			dist += pair.Dist
+		}
+		if dist != tt.dist {
+			t.Errorf("%s: distance %d, want %d", tt.name, dist, tt.dist)
+		}
+		if cmp.Matched+cmp.OnlyA != len(tt.a) || cmp.Matched+cmp.OnlyB != len(tt.b) {
+			t.Errorf("%s: matched %d, only a %d, only b %d", tt.name, cmp.Matched, cmp.OnlyA, cmp.OnlyB)
+		}
+	}
+}
+
+func TestCompareArchivesResolution(t *testing.T) {
+	a := testArchive(1, []uint64{0x0, 0xffff})
+	b := testArchive(2, []uint64{0x0, 0xffff})
+	for _, archive := range []*Archive{a, b} {
+		for _, image := range archive.Images {
+			image.Width, image.Height = 1000, 1500
+		}
+	}
+	b.Images[1].Width, b.Images[1].Height = 2000, 3000
+
+	setCheckOptions(CheckOptions{MaxImageDist: 3, MaxArchiveDiff: 10, HashAlgo: HashAverage})
+	cmp := compareArchives(a, b)
+	if cmp.Matched != 2 || cmp.Resolution != 1 || !cmp.Pairs[1].ResolutionDiffer() {
+		t.Errorf("matched %d, resolution differ %d, want 2 and 1", cmp.Matched, cmp.Resolution)
+	}
+}
@@ -1,15 +1,15 @@
 package core
 
 import (
-	"archive/zip"
 	"bytes"
+	"context"
 	"crypto/md5"
 	"fmt"
 	"image"
 	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
 	"image/png"
-	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -22,14 +22,23 @@ import (
 	"time"
 
 	"github.com/ninja-software/terror"
+	_ "golang.org/x/image/bmp"
 	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 )
 
 var (
-	reFileExtCBZ *regexp.Regexp = regexp.MustCompile("(?i)\\.cbz$")
-	reFileExtJPG *regexp.Regexp = regexp.MustCompile("(?i)\\.jp(e|)g$")
-	reFileExtPNG *regexp.Regexp = regexp.MustCompile("(?i)\\.png$")
-	sleepTime    time.Duration  = time.Millisecond * 300
+	reFileExtCBZ  *regexp.Regexp = regexp.MustCompile("(?i)\\.cbz$")
+	reFileExtCBR  *regexp.Regexp = regexp.MustCompile("(?i)\\.cbr$")
+	reFileExtCBT  *regexp.Regexp = regexp.MustCompile("(?i)\\.cbt$")
+	reFileExtCB7  *regexp.Regexp = regexp.MustCompile("(?i)\\.cb7$")
+	reFileExtJPG  *regexp.Regexp = regexp.MustCompile("(?i)\\.jp(e|)g$")
+	reFileExtPNG  *regexp.Regexp = regexp.MustCompile("(?i)\\.png$")
+	reFileExtGIF  *regexp.Regexp = regexp.MustCompile("(?i)\\.gif$")
+	reFileExtWEBP *regexp.Regexp = regexp.MustCompile("(?i)\\.webp$")
+	reFileExtBMP  *regexp.Regexp = regexp.MustCompile("(?i)\\.bmp$")
+	reFileExtTIFF *regexp.Regexp = regexp.MustCompile("(?i)\\.tif(f|)$")
 )
 
 // constants
@@ -38,13 +47,82 @@ const (
 	RPCPort = "4122"
 )
 
-func fileInode(file string) (uint64, error) {
-	fileinfo, _ := os.Stat(file)
+// ScanOptions options for scanning archives
+type ScanOptions struct {
+	ImageDirs bool     // treat leaf directory of images as an archive
+	HashAlgos []string // image hash algorithms, HashAverage if empty
+	StoreDir  string   // image sum store dir, "store" inside the first scan dir if empty
+	Force     bool     // rehash archives even if unchanged
+	MemBudget int64    // max bytes of page data read ahead of hashing, DefaultMemBudget if 0
+	InFlight  int      // max archives being hashed at once, number of cpus if 0
+}
+
+// DefaultMemBudget default bytes of page data read ahead of hashing
+const DefaultMemBudget = 512 << 20
+
+func (opts ScanOptions) memBudget() int64 {
+	if opts.MemBudget <= 0 {
+		return DefaultMemBudget
+	}
+	return opts.MemBudget
+}
+
+// storeDir store dir shared by every scan dir
+func (opts ScanOptions) storeDir(dirs []string) string {
+	if opts.StoreDir != "" || len(dirs) == 0 {
+		return opts.StoreDir
+	}
+	return filepath.Join(dirs[0], "store")
+}
+
+func (opts ScanOptions) inFlight() int {
+	if opts.InFlight <= 0 {
+		return runtime.NumCPU()
+	}
+	return opts.InFlight
+}
+
+func (opts ScanOptions) hashAlgos() []string {
+	if len(opts.HashAlgos) == 0 {
+		return []string{HashAverage}
+	}
+	return opts.HashAlgos
+}
+
+// fileID identity of file, inode is only unique within its device
+type fileID struct {
+	Dev uint64
+	Ino uint64
+}
+
+func (id fileID) String() string {
+	return fmt.Sprintf("%d:%d", id.Dev, id.Ino)
+}
+
+func fileIdentity(file string) (fileID, error) {
+	fileinfo, err := os.Stat(file)
+	if err != nil {
+		return fileID{}, err
+	}
 	stat, ok := fileinfo.Sys().(*syscall.Stat_t)
 	if !ok {
-		return 0, fmt.Errorf("Not a syscall.Stat_t")
+		return fileID{}, fmt.Errorf("Not a syscall.Stat_t")
+	}
+	return fileID{Dev: uint64(stat.Dev), Ino: stat.Ino}, nil
+}
+
+// scanNeeded check if archive has to be hashed, skipping archives stored with the same size and
+// modified time, and linking archives whose content fingerprint is stored
+func scanNeeded(st *Store, file string, id fileID, size int64, mtime time.Time, opts ScanOptions) bool {
+	if opts.Force {
+		return true
+	}
+	if st.Unchanged(file, id, size, mtime, opts.hashAlgos()) {
+		fmt.Fprintln(scanOut, "unchanged", file)
+		return false
 	}
-	return stat.Ino, nil
+	// touched, moved or copied archive keeps its image sums
+	return !linkKnown(st, file, id, size, mtime, opts.hashAlgos())
 }
 
 // fileInfo only check file info, not dir
@@ -63,9 +141,14 @@ func fileInfo(file string) os.FileInfo {
 	return info
 }
 
-// ListDir recursively list directory looking for cbz and queue jobs
-func ListDir(dir string) error {
-	fmt.Println("listing dir", dir)
+// ListDir recursively list directories looking for archives and queue jobs.
+// on cancel archives being hashed are finished and saved
+func ListDir(ctx context.Context, dirs []string, opts ScanOptions) error {
+	st, err := OpenStore(opts.storeDir(dirs))
+	if err != nil {
+		return terror.New(err, "")
+	}
+	defer st.Close()
 
 	// start multi-threading
 	cpus := runtime.NumCPU() - 1
@@ -73,42 +156,45 @@ func ListDir(dir string) error {
 	var wg sync.WaitGroup
 	wg.Add(cpus)
 	for i := 0; i < cpus; i++ {
-		go startThread(i, ch, &wg)
+		go startThread(i, ch, &wg, opts.hashAlgos(), st)
 	}
 
-	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
-		if err != nil {
-			return terror.New(err, "")
-		}
-		if info.IsDir() {
-			return nil
-		}
-		if !reFileExtCBZ.MatchString(info.Name()) {
-			return nil
-		}
+	for _, dir := range dirs {
+		fmt.Println("listing dir", dir)
 
-		// zip file inode
-		ino, err := fileInode(file)
-		if err != nil {
-			return terror.New(err, "")
-		}
-		// inode info file
-		inoFile := fmt.Sprintf("store/%d.txt", ino)
+		err = filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				return terror.New(err, "")
+			}
+			if !isScanTarget(file, info, opts.ImageDirs) {
+				return nil
+			}
+
+			// zip file identity
+			id, err := fileIdentity(file)
+			if err != nil {
+				return terror.New(err, "")
+			}
 
-		fi := fileInfo(inoFile)
-		if fi != nil && !fi.IsDir() && fi.Size() > 100 {
-			if fi.ModTime().AddDate(0, 0, 7).After(time.Now()) {
-				fmt.Println("prev scanned", file)
+			size, mtime := fileState(file, info)
+			if !scanNeeded(st, file, id, size, mtime, opts) {
 				return nil
 			}
-		}
 
-		ch <- file
+			select {
+			case ch <- file:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 
-		return nil
-	})
-	if err != nil {
-		return terror.New(err, "")
+			return nil
+		})
+		if err != nil {
+			break
+		}
 	}
 
 	// fill with exits
@@ -118,320 +204,420 @@ func ListDir(dir string) error {
 
 	wg.Wait()
 
+	if err != nil {
+		return terror.New(err, "")
+	}
 	return nil
 }
 
-// Queue for images in a zip file
-type Queue struct {
-	name string            // zip file name
-	ino  uint64            // zip file inode
-	zs   map[int]*ZipImage // in-memory image data
-	ds   map[int]bool      // 1:1 map to zs, marking ZipImage as done (regardless of success or failure)
-	cur  int               // cursor, last image nth
-	len  int               // queue length
-	mux  sync.Mutex        // read/write control flag
-	fin  bool              // finish (all zips) flag
+// scanPosition file of the walk over scan dirs
+type scanPosition struct {
+	dir  int    // index of scan dir
+	file string // walked file
 }
 
-// GetNext next ZipImage
-func (q *Queue) GetNext() *ZipImage {
-	q.mux.Lock()
-	if q.fin {
-		q.mux.Unlock()
-		return &ZipImage{
-			Inode: -1,
+// resumeFrom checkpoint of an interrupted scan of the same dirs, nil if there is nothing to resume
+func resumeFrom(st *Store, dirs []string) *scanCheckpoint {
+	cp := st.checkpoint()
+	if cp == nil || cp.Dir >= len(dirs) || len(cp.Dirs) != len(dirs) || !fileExist(cp.File) {
+		return nil
+	}
+	for i := range dirs {
+		if cp.Dirs[i] != dirs[i] {
+			return nil
 		}
 	}
-	zi := q.zs[q.cur]
-	q.cur++
-	q.mux.Unlock()
-	return zi
+	return cp
 }
 
-// Get nth ZipImage
-func (q *Queue) Get(n int) *ZipImage {
-	q.mux.Lock()
-	zi := q.zs[n]
-	q.mux.Unlock()
-	return zi
-}
-
-// Set nth ZipImage
-func (q *Queue) Set(n int, in *ZipImage) error {
-	zi := q.Get(n)
-	if zi == nil {
-		return fmt.Errorf("nth ZipImage not exist (%d)", n)
+// resumeFile file to resume walking scan dir of index di from, skip if the dir was done before the checkpoint
+func resumeFile(resume *scanCheckpoint, di int) (string, bool) {
+	if resume == nil || di > resume.Dir {
+		return "", false
 	}
-
-	q.mux.Lock()
-	zipImg := q.zs[n]
-
-	if in.Error == true {
-		zipImg.Error = true
-	} else {
-		zipImg.Parsed = true
-		zipImg.PHash = in.PHash
-		zipImg.Width = in.Width
-		zipImg.Height = in.Height
+	if di < resume.Dir {
+		return "", true
 	}
-	q.ds[n] = true
-	q.mux.Unlock()
-
-	return nil
+	return resume.File, false
 }
 
-// ListDirByQueue recursively list directory looking for cbz and queue jobs by images
-func ListDirByQueue(dir string, q *Queue, serverMode bool) error {
-	fmt.Println("listing dir by images", dir)
-
-	if !serverMode {
-		// start multi-threading
-		cpus := runtime.NumCPU()
-		for i := 0; i < cpus; i++ {
-			go startThreadByQueue(i, q)
-		}
-	}
-
-	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+// walkTargets walk dir calling fn for every archive, or image dir if imageDirs is set.
+// hidden files are skipped, so is everything before file from if set
+func walkTargets(dir string, imageDirs bool, from string, fn func(file string, info os.FileInfo) error) error {
+	return filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
 		if err != nil {
 			return terror.New(err, "")
 		}
-		if info.IsDir() {
-			return nil
+		// skip to where the interrupted scan stopped
+		if from != "" {
+			if file != from {
+				if info.IsDir() && file != dir && !strings.HasPrefix(from, file+string(filepath.Separator)) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			from = ""
 		}
-		if strings.HasPrefix(info.Name(), ".") {
+		if strings.HasPrefix(info.Name(), ".") && file != dir {
 			return nil
 		}
-		if !reFileExtCBZ.MatchString(info.Name()) {
+		if !isScanTarget(file, info, imageDirs) {
 			return nil
 		}
+		return fn(file, info)
+	})
+}
 
-		// zip file inode
-		ino, err := fileInode(file)
-		if err != nil {
-			return terror.New(err, "")
+// ListDirByQueue recursively list directories looking for archives and queue jobs by images.
+// pages of several archives are queued at once, each archive is saved once its pages are hashed.
+// every dir shares one store.
+// on cancel archives already hashed are saved and a checkpoint is kept, the next scan of the same dirs resumes from it
+func ListDirByQueue(ctx context.Context, dirs []string, q *Queue, serverMode bool, opts ScanOptions) error {
+	st, err := OpenStore(opts.storeDir(dirs))
+	if err != nil {
+		return terror.New(err, "")
+	}
+	defer st.Close()
+
+	q.setBudget(opts.memBudget())
+	stopQueue := context.AfterFunc(ctx, q.stop)
+	defer stopQueue()
+
+	resume := resumeFrom(st, dirs)
+
+	// progress of archives done against archives counted ahead of the scan
+	prog := newProgress(os.Stdout, os.Stderr)
+	q.setProgress(prog)
+	scanOut = prog
+	defer func() {
+		scanOut = os.Stdout
+	}()
+	countCtx, stopCount := context.WithCancel(ctx)
+	defer stopCount()
+	countDone := make(chan struct{})
+	go func() {
+		prog.count(countCtx, dirs, opts.ImageDirs, resume)
+		close(countDone)
+	}()
+	stopProgress := make(chan struct{})
+	progressDone := make(chan struct{})
+	go func() {
+		prog.run(stopProgress)
+		close(progressDone)
+	}()
+
+	// closed once no page is being hashed locally, rpc clients are not waited for
+	idle := make(chan struct{})
+	if !serverMode {
+		// start multi-threading
+		cpus := runtime.NumCPU()
+		var threads sync.WaitGroup
+		threads.Add(cpus)
+		for i := 0; i < cpus; i++ {
+			go func(i int) {
+				defer threads.Done()
+				startThreadByQueue(i, q)
+			}(i)
 		}
-		// inode info file
-		inoFile := fmt.Sprintf("store/%d.txt", ino)
+		go func() {
+			threads.Wait()
+			close(idle)
+		}()
+	} else {
+		close(idle)
+	}
 
-		fi := fileInfo(inoFile)
-		if fi != nil && !fi.IsDir() && fi.Size() > 100 {
-			if fi.ModTime().AddDate(0, 0, 7).After(time.Now()) {
-				fmt.Println("prev scanned", file)
-				return nil
+	// archives in flight, saved as they finish
+	inFlight := make(chan struct{}, opts.inFlight())
+	var wg sync.WaitGroup
+	var saveMux sync.Mutex
+	var saveErr error
+	unsaved := []scanPosition{} // archives started and not saved, in walk order
+	var stoppedAt *scanPosition // file the walk stopped at on cancel
+	saveFailed := func() error {
+		saveMux.Lock()
+		defer saveMux.Unlock()
+		return saveErr
+	}
+	// finished archive at pos, called with saveMux locked
+	finished := func(pos scanPosition) {
+		for i, p := range unsaved {
+			if p == pos {
+				unsaved = append(unsaved[:i], unsaved[i+1:]...)
+				break
 			}
 		}
+	}
 
-		// -- producer --
-		r, err := zip.OpenReader(file)
-		if err != nil {
-			return terror.New(err, "")
+	if resume != nil {
+		fmt.Fprintln(scanOut, "resuming from", resume.File)
+	}
+
+	for di, dir := range dirs {
+		from, skip := resumeFile(resume, di)
+		if skip {
+			continue
 		}
-		defer r.Close()
-
-		q.mux.Lock()
-		q.ino = ino
-		q.name = file
-		q.cur = 0
-		q.zs = map[int]*ZipImage{}
-		q.ds = map[int]bool{}
-		q.mux.Unlock()
-
-		rtotal := 0
-		for _, f := range r.File {
-			if !reFileExtJPG.MatchString(f.Name) && !reFileExtPNG.MatchString(f.Name) {
-				continue
+		fmt.Fprintln(scanOut, "listing dir by images", dir)
+
+		err = walkTargets(dir, opts.ImageDirs, from, func(file string, info os.FileInfo) error {
+			if ctx.Err() != nil {
+				stoppedAt = &scanPosition{di, file}
+				return ctx.Err()
+			}
+			if err := saveFailed(); err != nil {
+				return err
 			}
 
-			fp, err := f.Open()
+			// zip file identity
+			id, err := fileIdentity(file)
 			if err != nil {
 				return terror.New(err, "")
 			}
-			fdat, err := ioutil.ReadAll(fp)
-			if err != nil {
-				return terror.New(err, "")
+			size, mtime := fileState(file, info)
+			if !scanNeeded(st, file, id, size, mtime, opts) {
+				prog.skipped(size)
+				return nil
 			}
 
-			// add queue
-			q.mux.Lock()
-			q.zs[rtotal] = &ZipImage{
-				MTime:    info.ModTime(),
-				Name:     f.Name,
-				Inode:    int64(ino),
-				Nth:      rtotal,
-				CRC32:    f.CRC32,
-				MD5:      md5.Sum(fdat),
-				Data:     fdat,
-				DataSize: f.UncompressedSize64,
+			// -- producer --
+			select {
+			case inFlight <- struct{}{}:
+			case <-ctx.Done():
+				stoppedAt = &scanPosition{di, file}
+				return ctx.Err()
 			}
-			q.ds[rtotal] = false
-			q.mux.Unlock()
-
-			rtotal++
-		}
-		q.mux.Lock()
-		q.len = rtotal
-		q.mux.Unlock()
-		// -- /producer --
-
-		// blocking
-		// check if zip file is processed
-	FCheck:
-		for {
-			i := 0
-
-			q.mux.Lock()
-			len := q.len
-			for _, b := range q.ds {
-				if b {
-					i++
+			pos := scanPosition{di, file}
+			saveMux.Lock()
+			unsaved = append(unsaved, pos)
+			saveMux.Unlock()
+
+			job := newQueueJob()
+			err = readArchive(file, func(e *ArchiveEntry) error {
+				// add queue, waiting for hashed pages to free the budget
+				ok := q.add(job, &ZipImage{
+					MTime:     mtime,
+					Name:      e.Name,
+					Inode:     int64(id.Ino),
+					Nth:       len(job.images),
+					CRC32:     e.CRC32,
+					MD5:       md5.Sum(e.Data),
+					Data:      e.Data,
+					DataSize:  e.Size,
+					HashAlgos: opts.hashAlgos(),
+				})
+				if !ok {
+					return ctx.Err()
 				}
+				return nil
+			})
+			q.listed(job)
+			if ctx.Err() != nil {
+				<-inFlight
+				return ctx.Err()
 			}
-			q.mux.Unlock()
-
-			if i >= len-1 {
-				break FCheck
+			if err != nil {
+				// corrupt archive is skipped, queued pages still get hashed, wait for them before freeing the slot
+				fmt.Fprintln(scanOut, "err read archive", file, err)
+				prog.failed(size)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-job.done
+					<-inFlight
+					saveMux.Lock()
+					finished(pos)
+					saveMux.Unlock()
+				}()
+				return nil
 			}
-			time.Sleep(sleepTime)
-		}
+			// -- /producer --
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-inFlight }()
+
+				// blocking until every page of the archive is hashed
+				select {
+				case <-job.done:
+				case <-ctx.Done():
+					// pages being hashed may still finish the archive
+					<-idle
+					select {
+					case <-job.done:
+					default:
+						return
+					}
+				}
 
-		// print zip images result
-		q.mux.Lock()
-		zs := []*ZipImage{}
-		for _, zz := range q.zs {
-			zs = append(zs, zz)
-		}
-		// sort by filename
-		sort.Slice(zs, func(i, j int) bool {
-			return zs[i].Name < zs[j].Name
+				saveMux.Lock()
+				defer saveMux.Unlock()
+				err := saveJob(st, job, &Archive{
+					Name:   file,
+					MTime:  mtime,
+					Size:   size,
+					Dev:    id.Dev,
+					Inode:  int64(id.Ino),
+					Hashes: opts.hashAlgos(),
+				})
+				if err != nil {
+					if saveErr == nil {
+						saveErr = terror.New(err, "")
+					}
+					return
+				}
+				prog.archive(size)
+				finished(pos)
+			}()
+
+			return nil
 		})
-		// save phash record
-		txt := "# kagami_imgsum_ver: 1\n" + "# file: " + file + "\n"
-		for _, zz := range zs {
-			line := fmt.Sprintf("%08X %016X %9d %04d %04d %016X %s", zz.CRC32, zz.MD5, zz.DataSize, zz.Width, zz.Height, zz.PHash, zz.Name)
-			fmt.Println(line)
-			txt += line + "\n"
-		}
-		err = saveText(dir+"/"+inoFile, txt)
 		if err != nil {
-			if serverMode {
-				// kill and exit
-				log.Fatal("DONE")
-			} else {
-				return terror.New(err, "")
+			break
+		}
+	}
+
+	wg.Wait()
+	q.finish()
+	<-idle
+	stopCount()
+	<-countDone
+	close(stopProgress)
+	<-progressDone
+
+	if ctx.Err() != nil {
+		// resume from the first archive not saved, or where the walk stopped
+		var pos *scanPosition
+		if len(unsaved) > 0 {
+			pos = &unsaved[0]
+		} else if stoppedAt != nil {
+			pos = stoppedAt
+		}
+		if pos != nil {
+			cerr := st.setCheckpoint(&scanCheckpoint{
+				Dirs: dirs,
+				Dir:  pos.dir,
+				File: pos.file,
+				Time: time.Now(),
+			})
+			if cerr != nil {
+				return terror.New(cerr, "")
 			}
+			fmt.Fprintln(scanOut, "interrupted, next scan resumes from", pos.file)
+			return terror.New(ctx.Err(), "")
 		}
-		q.mux.Unlock()
+	}
 
-		return nil
-	})
+	if err == nil {
+		err = saveFailed()
+	}
 	if err != nil {
 		return terror.New(err, "")
 	}
 
-	q.mux.Lock()
-	q.fin = true
-	q.mux.Unlock()
-
-	if serverMode {
-		// kill and exit
-		log.Fatal("DONE")
+	// finished, nothing to resume
+	err = st.setCheckpoint(nil)
+	if err != nil {
+		return terror.New(err, "")
 	}
 
 	fmt.Println("DONE")
 	return nil
 }
 
-func listZip(file string) (string, error) {
-	ino, err := fileInode(file)
-	if err != nil {
-		return "", terror.New(err, "")
-	}
-	fmt.Printf("listing zip (%d) %s\n", ino, file)
-
-	r, err := zip.OpenReader(file)
-	if err != nil {
-		return "", terror.New(err, "")
-	}
-	defer r.Close()
-
-	lines := []string{}
-	for _, f := range r.File {
-		if !reFileExtJPG.MatchString(f.Name) && !reFileExtPNG.MatchString(f.Name) {
-			continue
-		}
-
-		hsh, w, h, hMD5, err := unzipImageInfo(f)
-		if err != nil {
-			return "", terror.New(err, "")
-		}
+// saveJob print and save the hashed pages of archive, sorted by name
+func saveJob(st *Store, job *queueJob, archive *Archive) error {
+	zs := job.images
+	// sort by filename
+	sort.Slice(zs, func(i, j int) bool {
+		return zs[i].Name < zs[j].Name
+	})
 
-		line := fmt.Sprintf("%08X %016X %9d %04d %04d %016X %s", f.CRC32, hMD5, f.UncompressedSize64, w, h, hsh, f.Name)
-		fmt.Println(line)
-		lines = append(lines, line)
+	// print zip images result
+	fmt.Fprintf(scanOut, "hashed (%s) %s\n", archive.id(), archive.Name)
+	for _, zz := range zs {
+		fmt.Fprintln(scanOut, sumLine(zz, archive.Hashes))
 	}
 
-	return strings.Join(lines, "\n"), nil
+	// save phash record
+	archive.Images = zs
+	return st.PutArchive(archive)
 }
 
-// unzipImageInfo create phash from zip.File.
-// phash, w, h
-func unzipImageInfo(f *zip.File) (uint64, int, int, [16]byte, error) {
-	var hshMD5 [16]byte
-
-	if !reFileExtJPG.MatchString(f.Name) && !reFileExtPNG.MatchString(f.Name) {
-		return 0, 0, 0, hshMD5, fmt.Errorf("not supported image extension")
+func listArchive(file string, algos []string) (*Archive, error) {
+	id, err := fileIdentity(file)
+	if err != nil {
+		return nil, terror.New(err, "")
 	}
+	fmt.Printf("listing archive (%s) %s\n", id, file)
 
-	rc, err := f.Open()
-	if err != nil {
-		return 0, 0, 0, hshMD5, terror.New(err, "")
+	archive := &Archive{
+		Name:   file,
+		Dev:    id.Dev,
+		Inode:  int64(id.Ino),
+		Hashes: algos,
 	}
-	var buf bytes.Buffer
-	tee := io.TeeReader(rc, &buf)
-	img, _, err := image.Decode(tee)
-	if err != nil {
-		return 0, 0, 0, hshMD5, terror.New(err, "")
+	if info, err := os.Stat(file); err == nil {
+		archive.Size, archive.MTime = fileState(file, info)
 	}
-	hshMD5 = md5.Sum(buf.Bytes())
-	img2, err := imageResize(img, draw.BiLinear)
-	if err != nil {
-		return 0, 0, 0, hshMD5, terror.New(err, "")
-	}
-	hsh, err := imagePHash(img2)
+
+	err = readArchive(file, func(e *ArchiveEntry) error {
+		hshs, w, h, format, err := ProcessImage(e.Data, algos)
+		if err != nil {
+			return terror.New(err, "")
+		}
+
+		zz := &ZipImage{
+			Inode:    int64(id.Ino),
+			Nth:      len(archive.Images),
+			CRC32:    e.CRC32,
+			MD5:      md5.Sum(e.Data),
+			DataSize: e.Size,
+			Width:    w,
+			Height:   h,
+			Format:   format,
+			Hashes:   hshs,
+			Name:     e.Name,
+		}
+		fmt.Println(sumLine(zz, algos))
+		archive.Images = append(archive.Images, zz)
+		return nil
+	})
 	if err != nil {
-		return 0, 0, 0, hshMD5, terror.New(err, "")
+		return nil, terror.New(err, "")
 	}
 
-	rect := img.Bounds().Max
-
-	return hsh, rect.X, rect.Y, hshMD5, nil
+	return archive, nil
 }
 
-// ProcessImage produce image phash, width, height
-func ProcessImage(dat []byte) (uint64, int, int, error) {
+// ProcessImage produce image hash for each algo, width, height, format.
+// gif uses the first frame. a decoder panic on a malformed page is returned as error
+func ProcessImage(dat []byte, algos []string) (hshs map[string]uint64, w int, h int, format string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			hshs, w, h, format, err = nil, 0, 0, "", fmt.Errorf("decode image panic: %v", r)
+		}
+	}()
+
 	r := bytes.NewReader(dat)
 
-	img, _, err := image.Decode(r)
+	img, format, err := image.Decode(r)
 	if err != nil {
-		return 0, 0, 0, terror.New(err, "")
+		return nil, 0, 0, "", terror.New(err, "")
 	}
-	img2, err := imageResize(img, draw.BiLinear)
+	hshs, err = imageHashes(img, algos)
 	if err != nil {
-		return 0, 0, 0, terror.New(err, "")
-	}
-	hsh, err := imagePHash(img2)
-	if err != nil {
-		return 0, 0, 0, terror.New(err, "")
+		return nil, 0, 0, "", terror.New(err, "")
 	}
 
 	rect := img.Bounds().Max
 
-	return hsh, rect.X, rect.Y, nil
+	return hshs, rect.X, rect.Y, format, nil
 }
 
 // scan base on zip file
-func startThread(cpu int, ch <-chan string, wg *sync.WaitGroup) {
+func startThread(cpu int, ch <-chan string, wg *sync.WaitGroup, algos []string, st *Store) {
 Loop:
 	for {
 		select {
@@ -440,17 +626,13 @@ Loop:
 				break Loop
 			}
 
-			// # list zip
-			txt, err := listZip(file)
-			txt = "# kagami_imgsum_ver: 1\n" + "# file: " + file + "\n" + txt
-
-			ino, err := fileInode(file)
+			// # list archive
+			archive, err := listArchive(file, algos)
 			if err != nil {
 				log.Println("Error go listZip", file)
 				continue
 			}
-			inoFile := fmt.Sprintf("store/%d.txt", ino)
-			err = saveText(inoFile, txt)
+			err = st.PutArchive(archive)
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -462,67 +644,53 @@ Loop:
 
 // ZipImage individual image file detail from zip file
 type ZipImage struct {
-	MTime    time.Time // zip file modified time
-	Inode    int64     // zip file inode, -1 means stop for rpc
-	Nth      int       // image file order in zip
-	CRC32    uint32    // image data crc32
-	MD5      [16]byte  // image data md5
-	Name     string    // image file path+name
-	Data     []byte    // image data
-	DataSize uint64    // image data size
-	Parsed   bool      // is image phashed
-	Error    bool      // is error
-	PHash    uint64    // image phash
-	Width    int       // image width
-	Height   int       // image height
+	MTime     time.Time         // zip file modified time
+	Inode     int64             // zip file inode, -1 means stop for rpc
+	Nth       int               // image file order in zip
+	QID       uint64            // page id in Queue, to set hash result back
+	CRC32     uint32            // image data crc32
+	MD5       [16]byte          // image data md5
+	Name      string            // image file path+name
+	Data      []byte            // image data
+	DataSize  uint64            // image data size
+	Parsed    bool              // is image phashed
+	Error     bool              // is error
+	HashAlgos []string          // image hash algorithms to produce
+	Hashes    map[string]uint64 // image hash by algorithm
+	Format    string            // image format, e.g. jpeg, png, webp
+	Width     int               // image width
+	Height    int               // image height
 }
 
 // scan base on image data
 func startThreadByQueue(cpu int, q *Queue) {
-	fmt.Println("starting thread", cpu)
+	fmt.Fprintln(scanOut, "starting thread", cpu)
 
 	for {
-		if q.cur >= q.len {
-			// todo wait until all others are finished
-
-			if q.fin {
-				// everything is done
-				break
-			}
-
-			time.Sleep(sleepTime)
-			continue
-		}
-
-		q.mux.Lock()
-		zipImg := q.zs[q.cur]
-		q.mux.Unlock()
+		zipImg := q.take(ownerLocal)
 		if zipImg == nil {
-			// not ready yet
-			time.Sleep(sleepTime)
-			continue
+			// everything is done
+			break
 		}
 
-		q.mux.Lock()
-		cursor := q.cur
-		q.cur++
-		q.mux.Unlock()
-
-		pHash, w, h, err := ProcessImage(zipImg.Data)
-		q.mux.Lock()
+		hshs, w, h, format, err := ProcessImage(zipImg.Data, zipImg.HashAlgos)
 		if err != nil {
 			zipImg.Error = true
 		} else {
 			zipImg.Parsed = true
-			zipImg.PHash = pHash
+			zipImg.Hashes = hshs
+			zipImg.Format = format
 			zipImg.Width = w
 			zipImg.Height = h
 		}
-		q.ds[cursor] = true
-		q.mux.Unlock()
+		zipImg.Data = nil
+		err = q.Set(ownerLocal, zipImg)
+		if err != nil {
+			fmt.Fprintln(scanOut, "err set", zipImg.Name, err)
+		}
 	}
 
-	fmt.Println("finished thread", cpu)
+	fmt.Fprintln(scanOut, "finished thread", cpu)
 }
 
 func saveText(file string, txt string) error {
@@ -540,13 +708,13 @@ func saveText(file string, txt string) error {
 	return nil
 }
 
-func imageResize(src image.Image, resizeMethod draw.Interpolator) (image.Image, error) {
+func imageResize(src image.Image, w, h int, resizeMethod draw.Interpolator) (image.Image, error) {
 	if src == nil {
 		return nil, fmt.Errorf("image is nil")
 	}
 
 	// dest image rect dimension
-	dr := image.Rect(0, 0, 8, 8)
+	dr := image.Rect(0, 0, w, h)
 
 	dst := image.NewRGBA(dr)
 
@@ -614,7 +782,7 @@ func basicResizeBench(img image.Image) error {
 	}
 	for i, resizeMethod := range resizeMethods {
 		tp := time.Now()
-		img2, err := imageResize(img, resizeMethod)
+		img2, err := imageResize(img, 8, 8, resizeMethod)
 		if err != nil {
 			return terror.New(err, "")
 		}
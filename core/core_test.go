@@ -0,0 +1,26 @@
+package core
+
+import (
+	"image"
+	"io"
+	"testing"
+)
+
+func init() {
+	// format whose decoder panics, standing in for a decoder bug on a malformed page
+	image.RegisterFormat("panic", "PANIC", func(r io.Reader) (image.Image, error) {
+		panic("bad page")
+	}, func(r io.Reader) (image.Config, error) {
+		panic("bad page")
+	})
+}
+
+func TestProcessImageRecoversDecoderPanic(t *testing.T) {
+	hshs, w, h, format, err := ProcessImage([]byte("PANIC page data"), []string{HashAverage})
+	if err == nil {
+		t.Fatal("expected error from panicking decoder")
+	}
+	if hshs != nil || w != 0 || h != 0 || format != "" {
+		t.Errorf("expected zero results, got %v %d %d %q", hshs, w, h, format)
+	}
+}
@@ -0,0 +1,78 @@
+package core
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// dct based perceptual hash
+
+// dctSize image size for dct hash
+const dctSize = 32
+
+// dctCos precalculated dct-ii cosine table, [u][x]
+var dctCos = func() [dctSize][dctSize]float64 {
+	var t [dctSize][dctSize]float64
+	for u := 0; u < dctSize; u++ {
+		for x := 0; x < dctSize; x++ {
+			t[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / float64(2*dctSize))
+		}
+	}
+	return t
+}()
+
+// dct1D 1 dimension dct-ii, only the first n coefficients
+func dct1D(in []float64, n int) []float64 {
+	out := make([]float64, n)
+	for u := 0; u < n; u++ {
+		sum := 0.0
+		for x, v := range in {
+			sum += v * dctCos[u][x]
+		}
+		out[u] = sum
+	}
+	return out
+}
+
+// imageDCTHash 32x32 image to 64bit hash.
+// grayscale, dct, keep low frequency 8x8 and threshold by median
+func imageDCTHash(img image.Image) (uint64, error) {
+	mx := img.Bounds().Max.X
+	my := img.Bounds().Max.Y
+
+	if mx != dctSize {
+		return 0, fmt.Errorf("image width not %d", dctSize)
+	}
+	if my != dctSize {
+		return 0, fmt.Errorf("image height not %d", dctSize)
+	}
+
+	// dct on rows, keep low 8 frequencies
+	rows := make([][]float64, dctSize)
+	for y := 0; y < dctSize; y++ {
+		row := make([]float64, dctSize)
+		for x := 0; x < dctSize; x++ {
+			row[x] = float64(calcGray(img.At(x, y)))
+		}
+		rows[y] = dct1D(row, 8)
+	}
+
+	// dct on columns of the low frequencies
+	coefs := make([]float64, 0, 64)
+	col := make([]float64, dctSize)
+	lows := make([][]float64, 8)
+	for x := 0; x < 8; x++ {
+		for y := 0; y < dctSize; y++ {
+			col[y] = rows[y][x]
+		}
+		lows[x] = dct1D(col, 8)
+	}
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			coefs = append(coefs, lows[u][v])
+		}
+	}
+
+	return medianBits(coefs), nil
+}
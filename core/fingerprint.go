@@ -0,0 +1,98 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/ninja-software/terror"
+)
+
+// content identity of archives, independent of path and inode
+
+// fingerprint sha256 over crc32 and size of every image in name order, hex encoded.
+// archives with the same images have the same fingerprint, whatever the file and page names
+func fingerprint(entries []*ArchiveEntry) string {
+	entries = append([]*ArchiveEntry{}, entries...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+
+	h := sha256.New()
+	b := make([]byte, 12)
+	for _, e := range entries {
+		binary.BigEndian.PutUint32(b[0:4], e.CRC32)
+		binary.BigEndian.PutUint64(b[4:12], e.Size)
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// imagesFingerprint fingerprint of hashed images
+func imagesFingerprint(images []*ZipImage) string {
+	entries := make([]*ArchiveEntry, len(images))
+	for i, image := range images {
+		entries[i] = &ArchiveEntry{
+			Name:  image.Name,
+			CRC32: image.CRC32,
+			Size:  image.DataSize,
+		}
+	}
+	return fingerprint(entries)
+}
+
+// archiveFingerprint fingerprint of archive file, read from the archive index when the format has one
+func archiveFingerprint(file string) (string, error) {
+	entries, err := listArchiveEntries(file)
+	if err != nil {
+		return "", terror.New(err, "")
+	}
+	return fingerprint(entries), nil
+}
+
+// fileState size and modified time of archive file for change detection.
+// image dir uses the total size of its images and the latest modified time of the dir and its images
+func fileState(file string, info os.FileInfo) (int64, time.Time) {
+	if !info.IsDir() {
+		return info.Size(), info.ModTime()
+	}
+
+	size := int64(0)
+	mtime := info.ModTime()
+	fis, err := ioutil.ReadDir(file)
+	if err != nil {
+		return 0, mtime
+	}
+	for _, fi := range fis {
+		if fi.IsDir() || !isImage(fi.Name()) {
+			continue
+		}
+		size += fi.Size()
+		if fi.ModTime().After(mtime) {
+			mtime = fi.ModTime()
+		}
+	}
+	return size, mtime
+}
+
+// linkKnown link archive file to stored content of the same fingerprint.
+// true if linked, so its pages need no hashing
+func linkKnown(st *Store, file string, id fileID, size int64, mtime time.Time, algos []string) bool {
+	fp, err := archiveFingerprint(file)
+	if err != nil || !st.Known(fp, algos) {
+		return false
+	}
+
+	err = st.Link(fp, file, id, size, mtime)
+	if err != nil {
+		fmt.Fprintln(scanOut, "err link", file, err)
+		return false
+	}
+	fmt.Fprintln(scanOut, "known content", file)
+	return true
+}
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestFingerprintIndependentOfEntryOrder(t *testing.T) {
+	entries := wantPages()
+	want := fingerprint(entries)
+
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 10; n++ {
+		shuffled := append([]*ArchiveEntry{}, entries...)
+		r.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		if got := fingerprint(shuffled); got != want {
+			t.Errorf("shuffle %d: fingerprint %s, want %s", n, got, want)
+		}
+	}
+
+	// listed entries carry no data, same fingerprint as walked
+	if got := fingerprint(withoutData(entries)); got != want {
+		t.Errorf("without data: fingerprint %s, want %s", got, want)
+	}
+}
+
+func TestFingerprintChangesWithContent(t *testing.T) {
+	want := fingerprint(wantPages())
+
+	changes := map[string]func(e *ArchiveEntry){
+		"crc32": func(e *ArchiveEntry) { e.CRC32++ },
+		"size":  func(e *ArchiveEntry) { e.Size++ },
+	}
+	for name, change := range changes {
+		entries := wantPages()
+		change(entries[1])
+		if fingerprint(entries) == want {
+			t.Errorf("%s changed, fingerprint the same", name)
+		}
+	}
+
+	if fingerprint(wantPages()[1:]) == want {
+		t.Error("page dropped, fingerprint the same")
+	}
+}
+
+func TestArchiveFingerprintStable(t *testing.T) {
+	dir := t.TempDir()
+	reversed := []testEntry{}
+	for i := len(testPages) - 1; i >= 0; i-- {
+		reversed = append(reversed, testPages[i])
+	}
+
+	zipFile := filepath.Join(dir, "a.cbz")
+	writeZipEntries(t, zipFile, testPages)
+	reversedFile := filepath.Join(dir, "reversed.cbz")
+	writeZipEntries(t, reversedFile, reversed)
+	tarFile := filepath.Join(dir, "a.cbt")
+	writeTarEntries(t, tarFile, reversed, "gzip")
+
+	// fingerprint of the stored images, sorted by name as saved
+	images := []*ZipImage{}
+	for _, e := range wantPages() {
+		images = append(images, &ZipImage{Name: e.Name, CRC32: e.CRC32, DataSize: e.Size})
+	}
+	want := imagesFingerprint(images)
+
+	for _, file := range []string{zipFile, reversedFile, tarFile} {
+		got, err := archiveFingerprint(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s: fingerprint %s, want %s", filepath.Base(file), got, want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ninja-software/terror"
+)
+
+// garbage collect store records of archives that no longer exist
+
+// GC check every archive location in store against the filesystem.
+// archives renamed within the scan dirs are found by file identity and relinked to their new path,
+// locations of archives that are gone are pruned, with content records no location holds.
+// dry run only lists what would change
+func GC(dirs []string, dryRun bool, opts ScanOptions) error {
+	st, err := OpenStore(opts.storeDir(dirs))
+	if err != nil {
+		return terror.New(err, "")
+	}
+	defer st.Close()
+
+	locs, err := st.locations(os.Stdout)
+	if err != nil {
+		return terror.New(err, "")
+	}
+
+	stale := []string{}
+	for name := range locs {
+		if !fileExist(name) {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+
+	// where archives of the scan dirs are now, by file identity
+	found := map[fileID]string{}
+	if len(stale) > 0 {
+		found, err = scanTargets(dirs, opts.ImageDirs)
+		if err != nil {
+			return terror.New(err, "")
+		}
+	}
+
+	verb := func(s string) string {
+		if dryRun {
+			return "would " + s
+		}
+		return s
+	}
+
+	total := len(locs)
+	relinked := 0
+	pruned := map[string]bool{}
+	for _, name := range stale {
+		loc := locs[name]
+		id := fileID{Dev: loc.Dev, Ino: uint64(loc.Inode)}
+
+		to, ok := found[id]
+		if ok && locs[to] == nil && sameContent(to, loc) {
+			fmt.Printf("%s (%s) %s -> %s\n", verb("relink"), id, name, to)
+			relinked++
+			locs[to] = loc
+			if dryRun {
+				continue
+			}
+			info, err := os.Stat(to)
+			if err != nil {
+				return terror.New(err, "")
+			}
+			size, mtime := fileState(to, info)
+			err = st.relink(name, to, id, size, mtime)
+			if err != nil {
+				return terror.New(err, "")
+			}
+			continue
+		}
+
+		fmt.Printf("%s (%s) %s\n", verb("prune"), id, name)
+		pruned[name] = true
+	}
+
+	// content records left without location once pruned, dry run counts the same as a real run
+	orphans, err := st.orphans(pruned)
+	if err != nil {
+		return terror.New(err, "")
+	}
+	for _, fp := range orphans {
+		fmt.Printf("%s record %s\n", verb("drop"), fp)
+	}
+
+	if !dryRun {
+		for _, name := range stale {
+			if !pruned[name] {
+				continue
+			}
+			err = st.DeleteArchive(name)
+			if err != nil {
+				return terror.New(err, "")
+			}
+		}
+		for _, fp := range orphans {
+			err = st.dropOrphan(fp)
+			if err != nil {
+				return terror.New(err, "")
+			}
+		}
+	}
+
+	summary := fmt.Sprintf("%d locations, relinked %d, pruned %d, dropped %d records", total, relinked, len(pruned), len(orphans))
+	if dryRun {
+		summary = "dry run, " + summary
+	}
+	fmt.Println(summary)
+	return nil
+}
+
+// scanTargets archives and image dirs inside dirs by file identity
+func scanTargets(dirs []string, imageDirs bool) (map[fileID]string, error) {
+	found := map[fileID]string{}
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return terror.New(err, "")
+			}
+			if strings.HasPrefix(info.Name(), ".") && file != dir {
+				return nil
+			}
+			if !isScanTarget(file, info, imageDirs) {
+				return nil
+			}
+			id, err := fileIdentity(file)
+			if err != nil {
+				return terror.New(err, "")
+			}
+			found[id] = file
+			return nil
+		})
+		if err != nil {
+			return nil, terror.New(err, "")
+		}
+	}
+	return found, nil
+}
+
+// sameContent check if archive file still has the content of location, by size and modified time,
+// otherwise by fingerprint
+func sameContent(file string, loc *storeLocation) bool {
+	info, err := os.Stat(file)
+	if err != nil {
+		return false
+	}
+	size, mtime := fileState(file, info)
+	if size == loc.Size && mtime.Equal(loc.MTime) {
+		return true
+	}
+	fp, err := archiveFingerprint(file)
+	return err == nil && fp == loc.Fingerprint
+}
@@ -0,0 +1,123 @@
+package core
+
+import (
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// gcStore store of lib holding a.cbz, which exists, and b.cbz, c.cbz, d.cbz, e.cbz, which are gone.
+// b.cbz alone holds its record, c.cbz and d.cbz share one, e.cbz shares the record of a.cbz
+func gcStore(t *testing.T) (lib, storeDir string) {
+	lib = filepath.Join(t.TempDir(), "lib")
+	storeDir = filepath.Join(t.TempDir(), "store")
+	if err := os.MkdirAll(lib, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(lib, "a.cbz"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := OpenStore(storeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	records := map[string]string{"a.cbz": "fa", "b.cbz": "fb", "c.cbz": "fc", "d.cbz": "fc", "e.cbz": "fa"}
+	for i, name := range []string{"a.cbz", "b.cbz", "c.cbz", "d.cbz", "e.cbz"} {
+		archive := testArchive(int64(i+1), []uint64{uint64(i)})
+		archive.Name = filepath.Join(lib, name)
+		archive.Fingerprint = records[name]
+		if err := st.PutArchive(archive); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return lib, storeDir
+}
+
+// storeState archive paths and record fingerprints left in store
+func storeState(t *testing.T, storeDir string) (names []string, fps []string) {
+	st, err := OpenStore(storeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	locs, err := st.locations(os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range locs {
+		names = append(names, filepath.Base(name))
+	}
+	sort.Strings(names)
+
+	err = st.db.View(func(tx *bolt.Tx) error {
+		for _, fp := range []string{"fa", "fb", "fc"} {
+			if tx.Bucket(bucketArchives).Get(archiveKey(fp)) != nil {
+				fps = append(fps, fp)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names, fps
+}
+
+// gcOutput run gc, returning what it printed
+func gcOutput(t *testing.T, lib, storeDir string, dryRun bool) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = GC([]string{lib}, dryRun, ScanOptions{StoreDir: storeDir})
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestGCDryRunCountsRecordsOfPrunedArchives(t *testing.T) {
+	lib, storeDir := gcStore(t)
+
+	dry := gcOutput(t, lib, storeDir, true)
+	if !strings.Contains(dry, "dry run, 5 locations, relinked 0, pruned 4, dropped 2 records") {
+		t.Errorf("dry run summary:\n%s", dry)
+	}
+	for _, fp := range []string{"fb", "fc"} {
+		if !strings.Contains(dry, "would drop record "+hex.EncodeToString(archiveKey(fp))) {
+			t.Errorf("dry run does not list record %s:\n%s", fp, dry)
+		}
+	}
+	names, fps := storeState(t, storeDir)
+	if len(names) != 5 || len(fps) != 3 {
+		t.Errorf("dry run changed store, left %v %v", names, fps)
+	}
+
+	out := gcOutput(t, lib, storeDir, false)
+	if !strings.Contains(out, "5 locations, relinked 0, pruned 4, dropped 2 records") {
+		t.Errorf("summary:\n%s", out)
+	}
+	names, fps = storeState(t, storeDir)
+	if !reflect.DeepEqual(names, []string{"a.cbz"}) || !reflect.DeepEqual(fps, []string{"fa"}) {
+		t.Errorf("left %v %v, want [a.cbz] [fa]", names, fps)
+	}
+}
@@ -0,0 +1,235 @@
+package core
+
+import (
+	"fmt"
+	"image"
+	"sort"
+	"strings"
+
+	"github.com/ninja-software/terror"
+	"golang.org/x/image/draw"
+)
+
+// image hash algorithms
+
+// image hash algorithm names
+const (
+	HashAverage    = "ahash" // average hash, 8x8 compare to mean luminance
+	HashDifference = "dhash" // difference hash, 9x8 compare to right neighbour
+	HashDCT        = "phash" // dct perceptual hash, 32x32 low frequency compare to median
+	HashWavelet    = "whash" // haar wavelet hash, 32x32 low frequency compare to median
+)
+
+// Hasher produce 64bit hash of an image, similar images have small hamming distance
+type Hasher interface {
+	// Name algorithm name recorded in store
+	Name() string
+	// Hash produce hash of image
+	Hash(img image.Image) (uint64, error)
+}
+
+var hashers = map[string]Hasher{
+	HashAverage:    averageHasher{},
+	HashDifference: differenceHasher{},
+	HashDCT:        dctHasher{},
+	HashWavelet:    waveletHasher{},
+}
+
+// RegisterHasher add image hash algorithm, replacing any with the same name.
+// not safe to call while scanning, register in init
+func RegisterHasher(h Hasher) {
+	hashers[h.Name()] = h
+}
+
+// GetHasher image hash algorithm by name
+func GetHasher(name string) (Hasher, error) {
+	h, ok := hashers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %s", name)
+	}
+	return h, nil
+}
+
+// ValidHashAlgo check if image hash algorithm is supported
+func ValidHashAlgo(algo string) bool {
+	_, ok := hashers[algo]
+	return ok
+}
+
+// HashAlgoNames supported image hash algorithm names, sorted
+func HashAlgoNames() []string {
+	names := []string{}
+	for name := range hashers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseHashAlgos parse comma separated image hash algorithm names
+func ParseHashAlgos(s string) ([]string, error) {
+	algos := []string{}
+	seen := map[string]bool{}
+	for _, algo := range strings.Split(s, ",") {
+		algo = strings.TrimSpace(algo)
+		if algo == "" || seen[algo] {
+			continue
+		}
+		if !ValidHashAlgo(algo) {
+			return nil, fmt.Errorf("unknown hash algorithm %s", algo)
+		}
+		seen[algo] = true
+		algos = append(algos, algo)
+	}
+	if len(algos) == 0 {
+		return nil, fmt.Errorf("no hash algorithm")
+	}
+	return algos, nil
+}
+
+// imageHashes produce image hash for each algo
+func imageHashes(img image.Image, algos []string) (map[string]uint64, error) {
+	hshs := map[string]uint64{}
+	for _, algo := range algos {
+		h, err := GetHasher(algo)
+		if err != nil {
+			return nil, err
+		}
+		hsh, err := h.Hash(img)
+		if err != nil {
+			return nil, terror.New(err, "")
+		}
+		hshs[algo] = hsh
+	}
+	return hshs, nil
+}
+
+// grayMatrix resize image to w x h and convert to luminance
+func grayMatrix(img image.Image, w, h int) ([][]float64, error) {
+	img2, err := imageResize(img, w, h, draw.BiLinear)
+	if err != nil {
+		return nil, terror.New(err, "")
+	}
+
+	m := make([][]float64, h)
+	for y := 0; y < h; y++ {
+		m[y] = make([]float64, w)
+		for x := 0; x < w; x++ {
+			m[y][x] = float64(calcGray(img2.At(x, y)))
+		}
+	}
+	return m, nil
+}
+
+// medianBits set bit for every value above median, first value is highest bit
+func medianBits(vals []float64) uint64 {
+	sorted := make([]float64, len(vals))
+	copy(sorted, vals)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var b uint64
+	for _, v := range vals {
+		if v > median {
+			b = 1 | b<<1
+		} else {
+			b = 0 | b<<1
+		}
+	}
+	return b
+}
+
+// averageHasher average hash
+type averageHasher struct{}
+
+func (averageHasher) Name() string {
+	return HashAverage
+}
+
+func (averageHasher) Hash(img image.Image) (uint64, error) {
+	img2, err := imageResize(img, 8, 8, draw.BiLinear)
+	if err != nil {
+		return 0, terror.New(err, "")
+	}
+	return imagePHash(img2)
+}
+
+// differenceHasher difference hash, gradient between horizontal neighbours
+type differenceHasher struct{}
+
+func (differenceHasher) Name() string {
+	return HashDifference
+}
+
+func (differenceHasher) Hash(img image.Image) (uint64, error) {
+	m, err := grayMatrix(img, 9, 8)
+	if err != nil {
+		return 0, terror.New(err, "")
+	}
+
+	var b uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if m[y][x] > m[y][x+1] {
+				b = 1 | b<<1
+			} else {
+				b = 0 | b<<1
+			}
+		}
+	}
+	return b, nil
+}
+
+// dctHasher dct perceptual hash
+type dctHasher struct{}
+
+func (dctHasher) Name() string {
+	return HashDCT
+}
+
+func (dctHasher) Hash(img image.Image) (uint64, error) {
+	img2, err := imageResize(img, dctSize, dctSize, draw.BiLinear)
+	if err != nil {
+		return 0, terror.New(err, "")
+	}
+	return imageDCTHash(img2)
+}
+
+// waveletHasher haar wavelet hash.
+// the dc component is not removed, median threshold is not affected by it
+type waveletHasher struct{}
+
+func (waveletHasher) Name() string {
+	return HashWavelet
+}
+
+func (waveletHasher) Hash(img image.Image) (uint64, error) {
+	m, err := grayMatrix(img, 32, 32)
+	if err != nil {
+		return 0, terror.New(err, "")
+	}
+
+	// 2 level haar decomposition, 32x32 -> 16x16 -> 8x8 approximation
+	for n := 32; n > 8; n /= 2 {
+		m = haarLL(m, n)
+	}
+
+	vals := make([]float64, 0, 64)
+	for y := 0; y < 8; y++ {
+		vals = append(vals, m[y]...)
+	}
+	return medianBits(vals), nil
+}
+
+// haarLL one level 2d haar transform of n x n matrix, returning the low-low band
+func haarLL(m [][]float64, n int) [][]float64 {
+	half := n / 2
+	ll := make([][]float64, half)
+	for y := 0; y < half; y++ {
+		ll[y] = make([]float64, half)
+		for x := 0; x < half; x++ {
+			ll[y][x] = (m[2*y][2*x] + m[2*y][2*x+1] + m[2*y+1][2*x] + m[2*y+1][2*x+1]) / 2
+		}
+	}
+	return ll
+}
@@ -0,0 +1,101 @@
+package core
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// grayImage w x h image with luminance f of x, y scaled to 0-1
+func grayImage(w, h int, f func(x, y float64) float64) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := f(float64(x)/float64(w), float64(y)/float64(h))
+			img.SetGray(x, y, color.Gray{uint8(math.Max(0, math.Min(255, v)))})
+		}
+	}
+	return img
+}
+
+// testPage smooth page-like pattern
+func testPage(x, y float64) float64 {
+	return 128 + 90*math.Sin(7*x+1)*math.Cos(5*y) + 30*math.Sin(23*x*y)
+}
+
+func TestHasherKnownAnswers(t *testing.T) {
+	tests := []struct {
+		algo string
+		img  *image.Gray
+		want uint64
+	}{
+		// left half bright, every row 11110000
+		{HashAverage, grayImage(64, 64, func(x, y float64) float64 { return 255 * math.Floor(1.5-x) }), 0xf0f0f0f0f0f0f0f0},
+		// brighter than the right neighbour everywhere
+		{HashDifference, grayImage(90, 80, func(x, y float64) float64 { return 255 * (1 - x) }), 0xffffffffffffffff},
+		// top half bright, above median in the first 4 rows
+		{HashWavelet, grayImage(64, 64, func(x, y float64) float64 { return 255 * math.Floor(1.5-y) }), 0xffffffff00000000},
+		// pinned, a change here invalidates every stored hash
+		{HashDCT, grayImage(400, 600, testPage), 0xdce1e699b324295a},
+		{HashWavelet, grayImage(400, 600, testPage), 0xe3e3e13c1c1c1cb5},
+	}
+
+	for _, tt := range tests {
+		h, err := GetHasher(tt.algo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := h.Hash(tt.img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s %v: got %#016x, want %#016x", tt.algo, tt.img.Bounds().Size(), got, tt.want)
+		}
+	}
+}
+
+func TestHasherDistances(t *testing.T) {
+	page := grayImage(400, 600, testPage)
+	variants := []struct {
+		name    string
+		img     *image.Gray
+		minDist int
+		maxDist int
+	}{
+		{"same page", grayImage(400, 600, testPage), 0, 0},
+		{"half size", grayImage(200, 300, testPage), 0, maxImageDist},
+		{"brighter", grayImage(400, 600, func(x, y float64) float64 { return testPage(x, y) + 20 }), 0, maxImageDist},
+		{"inverted", grayImage(400, 600, func(x, y float64) float64 { return 255 - testPage(x, y) }), 60, 64},
+		{"other page", grayImage(400, 600, func(x, y float64) float64 { return 128 + 100*math.Cos(11*y+2)*math.Sin(3*x) }), 20, 64},
+	}
+
+	for _, algo := range []string{HashDCT, HashWavelet} {
+		h, err := GetHasher(algo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		base, err := h.Hash(page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range variants {
+			hsh, err := h.Hash(v.img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dist := calcDist(base, hsh)
+			if dist < v.minDist || dist > v.maxDist {
+				t.Errorf("%s %s: distance %d, want %d-%d", algo, v.name, dist, v.minDist, v.maxDist)
+			}
+		}
+	}
+}
+
+func TestImageDCTHashRequiresDCTSize(t *testing.T) {
+	_, err := imageDCTHash(grayImage(dctSize, dctSize+1, testPage))
+	if err == nil {
+		t.Error("expected error for image not 32x32")
+	}
+}
@@ -0,0 +1,152 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// keeper selection policy for duplicate groups
+
+// keep rule names
+const (
+	KeepPages      = "pages"      // most pages
+	KeepResolution = "resolution" // highest median page resolution
+	KeepBytes      = "bytes"      // largest total page bytes
+	KeepPNG        = "png"        // most png pages over jpeg
+	KeepNewest     = "newest"     // newest archive modified time
+	KeepPath       = "path:"      // path matches pattern, e.g. path:(?i)official
+)
+
+// keepRule score archive, higher score is kept
+type keepRule func(archive *Archive) float64
+
+// KeepPolicy ordered keep rules, later rules break ties of earlier rules
+type KeepPolicy []keepRule
+
+// ParseKeepPolicy parse comma separated keep rules.
+// empty policy keeps the first archive by path
+func ParseKeepPolicy(s string) (KeepPolicy, error) {
+	policy := KeepPolicy{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		switch {
+		case name == KeepPages:
+			policy = append(policy, keepPages)
+		case name == KeepResolution:
+			policy = append(policy, keepResolution)
+		case name == KeepBytes:
+			policy = append(policy, keepBytes)
+		case name == KeepPNG:
+			policy = append(policy, keepPNG)
+		case name == KeepNewest:
+			policy = append(policy, keepNewest)
+		case strings.HasPrefix(name, KeepPath):
+			re, err := regexp.Compile(strings.TrimPrefix(name, KeepPath))
+			if err != nil {
+				return nil, fmt.Errorf("invalid keep path pattern %s", name)
+			}
+			policy = append(policy, func(archive *Archive) float64 {
+				if re.MatchString(archive.Name) {
+					return 1
+				}
+				return 0
+			})
+		default:
+			return nil, fmt.Errorf("unknown keep rule %s", name)
+		}
+	}
+	return policy, nil
+}
+
+// selectKeeper reorder group so the head is the archive kept by policy.
+// ties keep the existing order
+func (policy KeepPolicy) selectKeeper(dup *DupArchive) {
+	if len(policy) == 0 {
+		return
+	}
+
+	members := append([]*Archive{dup.Head}, dup.Dups...)
+	scores := make(map[*Archive][]float64, len(members))
+	for _, archive := range members {
+		for _, rule := range policy {
+			scores[archive] = append(scores[archive], rule(archive))
+		}
+	}
+
+	sort.SliceStable(members, func(i, j int) bool {
+		si, sj := scores[members[i]], scores[members[j]]
+		for r := range si {
+			if si[r] != sj[r] {
+				return si[r] > sj[r]
+			}
+		}
+		return false
+	})
+
+	dup.Head = members[0]
+	dup.Dups = members[1:]
+}
+
+func keepPages(archive *Archive) float64 {
+	return float64(len(archive.Images))
+}
+
+// medianImage image with the median resolution of archive
+func medianImage(archive *Archive) *ZipImage {
+	if len(archive.Images) == 0 {
+		return nil
+	}
+	images := append([]*ZipImage{}, archive.Images...)
+	sort.SliceStable(images, func(i, j int) bool {
+		return images[i].Width*images[i].Height < images[j].Width*images[j].Height
+	})
+	return images[len(images)/2]
+}
+
+func keepResolution(archive *Archive) float64 {
+	image := medianImage(archive)
+	if image == nil {
+		return 0
+	}
+	return float64(image.Width * image.Height)
+}
+
+func keepBytes(archive *Archive) float64 {
+	total := uint64(0)
+	for _, image := range archive.Images {
+		total += image.DataSize
+	}
+	return float64(total)
+}
+
+func keepPNG(archive *Archive) float64 {
+	if len(archive.Images) == 0 {
+		return 0
+	}
+	png := 0
+	for _, image := range archive.Images {
+		if image.Format == "png" {
+			png++
+		}
+	}
+	return float64(png) / float64(len(archive.Images))
+}
+
+func keepNewest(archive *Archive) float64 {
+	mtime := archive.MTime
+	if mtime.IsZero() {
+		info, err := os.Stat(archive.Name)
+		if err != nil {
+			return 0
+		}
+		mtime = info.ModTime()
+	}
+	return float64(mtime.UnixNano())
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+// keepArchive archive of n pages of w x h in format, each size bytes
+func keepArchive(name string, n, w, h int, size uint64, format string, mtime time.Time) *Archive {
+	archive := &Archive{Name: name, MTime: mtime}
+	for i := 0; i < n; i++ {
+		archive.Images = append(archive.Images, &ZipImage{Nth: i, Width: w, Height: h, DataSize: size, Format: format})
+	}
+	return archive
+}
+
+func TestKeepPolicyOrdering(t *testing.T) {
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := old.Add(time.Hour)
+
+	// each case, the archive kept wins on one rule and loses every later rule
+	tests := []struct {
+		rule  string
+		other *Archive
+		keep  *Archive
+	}{
+		{KeepPages,
+			keepArchive("/official/b.cbz", 8, 2000, 3000, 900, "png", newer),
+			keepArchive("/scan/a.cbz", 9, 1000, 1500, 100, "jpeg", old)},
+		{KeepResolution,
+			keepArchive("/official/b.cbz", 8, 1000, 1500, 900, "png", newer),
+			keepArchive("/scan/a.cbz", 8, 2000, 3000, 100, "jpeg", old)},
+		{KeepBytes,
+			keepArchive("/official/b.cbz", 8, 1000, 1500, 100, "png", newer),
+			keepArchive("/scan/a.cbz", 8, 1000, 1500, 900, "jpeg", old)},
+		{KeepPNG,
+			keepArchive("/official/b.cbz", 8, 1000, 1500, 100, "jpeg", newer),
+			keepArchive("/scan/a.cbz", 8, 1000, 1500, 100, "png", old)},
+		{KeepNewest,
+			keepArchive("/official/b.cbz", 8, 1000, 1500, 100, "png", old),
+			keepArchive("/scan/a.cbz", 8, 1000, 1500, 100, "png", newer)},
+		{KeepPath,
+			keepArchive("/scan/b.cbz", 8, 1000, 1500, 100, "png", old),
+			keepArchive("/official/a.cbz", 8, 1000, 1500, 100, "png", old)},
+	}
+
+	policy, err := ParseKeepPolicy("pages, resolution, bytes, png, newest, path:official")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		dup := &DupArchive{Head: tt.other, Dups: []*Archive{tt.keep}}
+		policy.selectKeeper(dup)
+		if dup.Head != tt.keep || len(dup.Dups) != 1 || dup.Dups[0] != tt.other {
+			t.Errorf("%s: kept %s, want %s", tt.rule, dup.Head.Name, tt.keep.Name)
+		}
+	}
+}
+
+func TestKeepPolicyTieKeepsOrder(t *testing.T) {
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := keepArchive("/lib/a.cbz", 8, 1000, 1500, 100, "png", mtime)
+	b := keepArchive("/lib/b.cbz", 8, 1000, 1500, 100, "png", mtime)
+	c := keepArchive("/lib/c.cbz", 8, 1000, 1500, 100, "png", mtime)
+
+	for _, s := range []string{"", "pages,resolution,bytes,png,newest,path:official"} {
+		policy, err := ParseKeepPolicy(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dup := &DupArchive{Head: a, Dups: []*Archive{b, c}}
+		policy.selectKeeper(dup)
+		if dup.Head != a || dup.Dups[0] != b || dup.Dups[1] != c {
+			t.Errorf("policy %q: order %s %s %s, want a b c", s, dup.Head.Name, dup.Dups[0].Name, dup.Dups[1].Name)
+		}
+	}
+}
+
+func TestKeepResolutionUsesMedianPage(t *testing.T) {
+	// one huge cover does not outweigh small pages
+	covered := keepArchive("/lib/a.cbz", 4, 800, 1200, 100, "jpeg", time.Time{})
+	covered.Images[0].Width, covered.Images[0].Height = 4000, 6000
+	even := keepArchive("/lib/b.cbz", 4, 1000, 1500, 100, "jpeg", time.Time{})
+
+	if keepResolution(covered) >= keepResolution(even) {
+		t.Errorf("resolution %v not below %v", keepResolution(covered), keepResolution(even))
+	}
+}
+
+func TestParseKeepPolicyInvalid(t *testing.T) {
+	for _, s := range []string{"largest", "pages,size", "path:("} {
+		_, err := ParseKeepPolicy(s)
+		if err == nil {
+			t.Errorf("policy %q: expected error", s)
+		}
+	}
+}
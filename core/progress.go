@@ -0,0 +1,265 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// scan progress with throughput and eta
+
+var (
+	// scanOut where scan messages go, progress reporter while scanning
+	scanOut io.Writer = os.Stdout
+	// progressTTYInterval status line redraw interval on a terminal
+	progressTTYInterval = time.Second
+	// progressJSONInterval json progress line interval when output is not a terminal
+	progressJSONInterval = 10 * time.Second
+)
+
+// progress scan progress reporter, writes a status line kept below scan messages on a terminal,
+// otherwise a json line every progressJSONInterval to its own writer, so scan output stays parseable
+type progress struct {
+	mux     sync.Mutex
+	out     io.Writer
+	jsonOut io.Writer // json progress lines when out is not a terminal
+	tty     bool
+	status  string    // status line shown on terminal
+	started time.Time // scan start
+
+	total       int       // candidate archives counted
+	totalSize   int64     // size of candidate archives counted
+	counted     bool      // every candidate archive is counted
+	done        int       // candidate archives saved or skipped
+	doneSize    int64     // size of candidate archives saved or skipped
+	skips       int       // candidate archives skipped as unchanged or known, counted in done
+	skippedSize int64     // size of candidate archives skipped, counted in doneSize
+	failures    int       // candidate archives skipped as unreadable, counted in done
+	pages       int64     // pages hashed
+	bytes       int64     // page data bytes hashed
+	hashStarted time.Time // first page hashed, skipping before it is not hashing time
+}
+
+// progressLine json progress line
+type progressLine struct {
+	Time        time.Time `json:"time"`
+	Archives    int       `json:"archives"`
+	Total       int       `json:"total"`
+	Skipped     int       `json:"skipped"`      // archives skipped as unchanged or known
+	SkippedSize int64     `json:"skippedBytes"` // size of archives skipped
+	Failed      int       `json:"failed"`       // archives skipped as unreadable
+	Counting    bool      `json:"counting"`     // total still being counted
+	Pages       int64     `json:"pages"`
+	PagesPerSec float64   `json:"pagesPerSec"`
+	BytesPerSec int64     `json:"bytesPerSec"`
+	ETA         int64     `json:"etaSec"` // -1 if unknown
+}
+
+// newProgress progress of scan messages written to f, json progress lines to jsonOut
+func newProgress(f *os.File, jsonOut io.Writer) *progress {
+	tty := false
+	if info, err := f.Stat(); err == nil {
+		tty = info.Mode()&os.ModeCharDevice != 0
+	}
+	return &progress{
+		out:     f,
+		jsonOut: jsonOut,
+		tty:     tty,
+		started: time.Now(),
+	}
+}
+
+// Write scan message, on terminal the status line is cleared and drawn again below it
+func (p *progress) Write(b []byte) (int, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if !p.tty {
+		return p.out.Write(b)
+	}
+	fmt.Fprint(p.out, "\r\033[K")
+	n, err := p.out.Write(b)
+	fmt.Fprint(p.out, p.status)
+	return n, err
+}
+
+// count pre-count candidate archives of scan dirs, from the resume checkpoint if set
+func (p *progress) count(ctx context.Context, dirs []string, imageDirs bool, resume *scanCheckpoint) {
+	for di, dir := range dirs {
+		from, skip := resumeFile(resume, di)
+		if skip {
+			continue
+		}
+		err := walkTargets(dir, imageDirs, from, func(file string, info os.FileInfo) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			size, _ := fileState(file, info)
+			p.mux.Lock()
+			p.total++
+			p.totalSize += size
+			p.mux.Unlock()
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	p.mux.Lock()
+	p.counted = true
+	p.mux.Unlock()
+}
+
+// archive count candidate archive of size as saved or skipped
+func (p *progress) archive(size int64) {
+	p.mux.Lock()
+	p.done++
+	p.doneSize += size
+	p.mux.Unlock()
+}
+
+// skipped count candidate archive of size as skipped without hashing
+func (p *progress) skipped(size int64) {
+	p.mux.Lock()
+	p.done++
+	p.doneSize += size
+	p.skips++
+	p.skippedSize += size
+	p.mux.Unlock()
+}
+
+// failed count candidate archive of size as skipped for being unreadable
+func (p *progress) failed(size int64) {
+	p.mux.Lock()
+	p.done++
+	p.doneSize += size
+	p.failures++
+	p.mux.Unlock()
+}
+
+// page count page hashed
+func (p *progress) page(size uint64) {
+	p.mux.Lock()
+	if p.pages == 0 {
+		p.hashStarted = time.Now()
+	}
+	p.pages++
+	p.bytes += int64(size)
+	p.mux.Unlock()
+}
+
+// line progress so far, called with mux locked
+func (p *progress) line() *progressLine {
+	elapsed := time.Since(p.started).Seconds()
+	l := &progressLine{
+		Time:        time.Now(),
+		Archives:    p.done,
+		Total:       p.total,
+		Skipped:     p.skips,
+		SkippedSize: p.skippedSize,
+		Failed:      p.failures,
+		Counting:    !p.counted,
+		Pages:       p.pages,
+		ETA:         -1,
+	}
+	if elapsed > 0 {
+		l.PagesPerSec = math.Round(float64(p.pages)/elapsed*10) / 10
+		l.BytesPerSec = int64(float64(p.bytes) / elapsed)
+	}
+	// archive size left at the rate page data is hashed, skipped archives take next to no time
+	hashing := time.Since(p.hashStarted).Seconds()
+	if p.counted && p.bytes > 0 && hashing > 0 {
+		l.ETA = int64(float64(p.totalSize-p.doneSize) / (float64(p.bytes) / hashing))
+		if l.ETA < 0 {
+			l.ETA = 0
+		}
+	}
+	return l
+}
+
+// statusLine progress as terminal status line
+func statusLine(l *progressLine) string {
+	total := fmt.Sprint(l.Total)
+	if l.Counting {
+		total += "+"
+	}
+	pct := ""
+	if !l.Counting && l.Total > 0 {
+		pct = fmt.Sprintf(" (%d%%)", l.Archives*100/l.Total)
+	}
+	eta := "?"
+	if l.ETA >= 0 {
+		eta = (time.Duration(l.ETA) * time.Second).String()
+	}
+	failed := ""
+	if l.Skipped > 0 {
+		failed += fmt.Sprintf(" (%d skipped)", l.Skipped)
+	}
+	if l.Failed > 0 {
+		failed += fmt.Sprintf(" (%d failed)", l.Failed)
+	}
+	return fmt.Sprintf("archives %d/%s%s%s  pages %d %.1f/s  %s/s  eta %s",
+		l.Archives, total, pct, failed, l.Pages, l.PagesPerSec, byteSize(float64(l.BytesPerSec)), eta)
+}
+
+// byteSize human readable bytes
+func byteSize(b float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for b >= 1024 && i < len(units)-1 {
+		b /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", b, units[i])
+}
+
+// report write progress, status line on terminal, json line otherwise
+func (p *progress) report() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	l := p.line()
+	if p.tty {
+		p.status = statusLine(l)
+		fmt.Fprint(p.out, "\r\033[K"+p.status)
+		return
+	}
+	b, err := json.Marshal(l)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(p.jsonOut, string(b))
+}
+
+// run report progress every interval until stop is closed, then a last time
+func (p *progress) run(stop <-chan struct{}) {
+	interval := progressJSONInterval
+	if p.tty {
+		interval = progressTTYInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.report()
+		case <-stop:
+			p.report()
+			if p.tty {
+				// keep the last status line
+				p.mux.Lock()
+				p.status = ""
+				fmt.Fprintln(p.out)
+				p.mux.Unlock()
+			}
+			return
+		}
+	}
+}
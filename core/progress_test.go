@@ -0,0 +1,63 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProgressJSONLinesKeptOffScanOutput(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	jsonOut := &bytes.Buffer{}
+	p := newProgress(f, jsonOut)
+	fmt.Fprintln(p, "unchanged /lib/a.cbz")
+	p.archive(10)
+	p.report()
+
+	out, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "unchanged /lib/a.cbz\n" {
+		t.Errorf("scan output %q", out)
+	}
+
+	l := &progressLine{}
+	if err := json.Unmarshal(jsonOut.Bytes(), l); err != nil {
+		t.Fatalf("progress line %q: %v", jsonOut.String(), err)
+	}
+	if l.Archives != 1 {
+		t.Errorf("progress archives %d, want 1", l.Archives)
+	}
+}
+
+func TestProgressETAFromHashedBytes(t *testing.T) {
+	p := &progress{started: time.Now().Add(-20 * time.Second), total: 100, totalSize: 1000, counted: true}
+
+	// most of the library unchanged, skipped at once
+	for i := 0; i < 90; i++ {
+		p.skipped(10)
+	}
+	// 50 bytes hashed in 10s
+	p.page(50)
+	p.hashStarted = time.Now().Add(-10 * time.Second)
+	p.archive(50)
+
+	l := p.line()
+	if l.Skipped != 90 || l.SkippedSize != 900 || l.Archives != 91 {
+		t.Errorf("skipped %d (%d bytes), archives %d", l.Skipped, l.SkippedSize, l.Archives)
+	}
+	// 50 bytes left at 5 bytes/s
+	if l.ETA < 9 || l.ETA > 11 {
+		t.Errorf("eta %ds, want about 10s", l.ETA)
+	}
+}
@@ -0,0 +1,237 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// queue of pages waiting to be hashed by local threads or rpc clients
+
+// queueJob pages of one archive in the queue
+type queueJob struct {
+	images  []*ZipImage   // every page of the archive, in archive order
+	pending int           // pages queued or being hashed
+	listed  bool          // every page of the archive is queued
+	done    chan struct{} // closed once listed and every page is hashed
+}
+
+func newQueueJob() *queueJob {
+	return &queueJob{
+		images: []*ZipImage{},
+		done:   make(chan struct{}),
+	}
+}
+
+// ownerLocal owner of pages taken by local threads, rpc clients are numbered from 1
+const ownerLocal uint64 = 0
+
+// queuePage page taken for hashing and not yet set
+type queuePage struct {
+	job   *queueJob
+	zi    *ZipImage
+	owner uint64 // taken by local threads or rpc client
+}
+
+// Queue pages of archives waiting to be hashed.
+// page data is streamed in while earlier pages are hashed, holding at most budget bytes of unhashed data
+type Queue struct {
+	mux     sync.Mutex
+	cond    *sync.Cond            // signalled when a page is queued, page data is released or queue is finished or stopped
+	waiting []*queuePage          // pages to hash, in queue order
+	lent    map[uint64]*queuePage // pages being hashed, by queue id
+	gone    map[uint64]bool       // owners released, no more pages are lent to them
+	lastID  uint64                // last page queue id given
+	budget  int64                 // max bytes of page data held, no limit if 0
+	held    int64                 // bytes of page data held, queued or being hashed
+	fin     bool                  // finish (all zips) flag
+	stopped bool                  // scan cancelled, queued pages are dropped
+	report  *progress             // counts hashed pages, if set
+}
+
+// init create condition and maps on first use, called with mux locked
+func (q *Queue) init() {
+	if q.cond == nil {
+		q.cond = sync.NewCond(&q.mux)
+		q.lent = map[uint64]*queuePage{}
+		q.gone = map[uint64]bool{}
+	}
+}
+
+// setBudget max bytes of unhashed page data held
+func (q *Queue) setBudget(budget int64) {
+	q.mux.Lock()
+	q.budget = budget
+	q.mux.Unlock()
+}
+
+// setProgress count hashed pages in progress
+func (q *Queue) setProgress(p *progress) {
+	q.mux.Lock()
+	q.report = p
+	q.mux.Unlock()
+}
+
+// add queue page of job, waiting until its data fits the budget. a page larger than budget is let in alone.
+// false if the queue is stopped
+func (q *Queue) add(job *queueJob, zi *ZipImage) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.init()
+
+	size := int64(len(zi.Data))
+	for !q.stopped && q.budget > 0 && q.held > 0 && q.held+size > q.budget {
+		q.cond.Wait()
+	}
+	if q.stopped {
+		return false
+	}
+	q.held += size
+
+	q.lastID++
+	zi.QID = q.lastID
+	job.images = append(job.images, zi)
+	job.pending++
+	q.waiting = append(q.waiting, &queuePage{job: job, zi: zi})
+	q.cond.Broadcast()
+	return true
+}
+
+// listed mark every page of job queued
+func (q *Queue) listed(job *queueJob) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	job.listed = true
+	if job.pending == 0 {
+		close(job.done)
+	}
+}
+
+// finish no more pages will be queued, threads waiting for pages are let go
+func (q *Queue) finish() {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.init()
+
+	q.fin = true
+	q.cond.Broadcast()
+}
+
+// stop drop queued pages and let go of everything waiting on the queue.
+// pages being hashed can still be set, archives with dropped pages never finish
+func (q *Queue) stop() {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.init()
+
+	q.stopped = true
+	for _, p := range q.waiting {
+		q.held -= int64(len(p.zi.Data))
+		p.zi.Data = nil
+	}
+	q.waiting = nil
+	q.cond.Broadcast()
+}
+
+// take wait for the next page to hash for owner, nil once the queue is finished and empty, stopped or owner released.
+// the page is a copy, results go back by Set
+func (q *Queue) take(owner uint64) *ZipImage {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.init()
+
+	for len(q.waiting) == 0 && !q.fin && !q.stopped && !q.gone[owner] {
+		q.cond.Wait()
+	}
+	if len(q.waiting) == 0 || q.gone[owner] {
+		return nil
+	}
+
+	p := q.waiting[0]
+	q.waiting[0] = nil
+	q.waiting = q.waiting[1:]
+	p.owner = owner
+	q.lent[p.zi.QID] = p
+
+	zi := *p.zi
+	return &zi
+}
+
+// GetNext wait for the next ZipImage to hash for rpc client owner, Inode -1 once the queue is finished,
+// stopped or owner released
+func (q *Queue) GetNext(owner uint64) *ZipImage {
+	zi := q.take(owner)
+	if zi == nil {
+		return &ZipImage{
+			Inode: -1,
+		}
+	}
+	return zi
+}
+
+// Set hash result of ZipImage taken from queue by owner, releasing its page data
+func (q *Queue) Set(owner uint64, in *ZipImage) error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.init()
+
+	p, ok := q.lent[in.QID]
+	if !ok || p.owner != owner {
+		return fmt.Errorf("ZipImage not taken from queue (%d)", in.QID)
+	}
+	delete(q.lent, in.QID)
+
+	zipImg := p.zi
+	if in.Error {
+		zipImg.Error = true
+	} else {
+		zipImg.Parsed = true
+		zipImg.Hashes = in.Hashes
+		zipImg.Format = in.Format
+		zipImg.Width = in.Width
+		zipImg.Height = in.Height
+	}
+	q.held -= int64(len(zipImg.Data))
+	zipImg.Data = nil
+	if q.report != nil {
+		q.report.page(zipImg.DataSize)
+	}
+
+	p.job.pending--
+	if p.job.listed && p.job.pending == 0 {
+		close(p.job.done)
+	}
+	q.cond.Broadcast()
+	return nil
+}
+
+// Release requeue pages lent to rpc client owner ahead of waiting pages, once its connection is gone.
+// no more pages are lent to owner and its late results are refused
+func (q *Queue) Release(owner uint64) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.init()
+
+	q.gone[owner] = true
+
+	back := []*queuePage{}
+	for qid, p := range q.lent {
+		if p.owner != owner {
+			continue
+		}
+		delete(q.lent, qid)
+		if q.stopped {
+			// dropped like queued pages
+			q.held -= int64(len(p.zi.Data))
+			p.zi.Data = nil
+			continue
+		}
+		back = append(back, p)
+	}
+	sort.Slice(back, func(i, j int) bool {
+		return back[i].zi.QID < back[j].zi.QID
+	})
+	q.waiting = append(back, q.waiting...)
+	q.cond.Broadcast()
+}
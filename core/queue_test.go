@@ -0,0 +1,197 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+// returnsWithin check if done is closed within a short wait
+func returnsWithin(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	case <-time.After(100 * time.Millisecond):
+		return false
+	}
+}
+
+func queuePageOf(size int) *ZipImage {
+	return &ZipImage{Data: make([]byte, size)}
+}
+
+func TestQueueAddBlocksOverBudget(t *testing.T) {
+	q := &Queue{}
+	q.setBudget(10)
+	job := newQueueJob()
+
+	if !q.add(job, queuePageOf(8)) {
+		t.Fatal("first page refused")
+	}
+
+	added := make(chan struct{})
+	go func() {
+		q.add(job, queuePageOf(8))
+		close(added)
+	}()
+	if returnsWithin(added) {
+		t.Fatal("page over budget added before data was released")
+	}
+
+	zi := q.take(ownerLocal)
+	if err := q.Set(ownerLocal, zi); err != nil {
+		t.Fatal(err)
+	}
+	if !returnsWithin(added) {
+		t.Fatal("page not added after data was released")
+	}
+
+	// larger than budget is let in alone
+	if err := q.Set(ownerLocal, q.take(ownerLocal)); err != nil {
+		t.Fatal(err)
+	}
+	if !q.add(job, queuePageOf(20)) {
+		t.Fatal("page larger than budget refused")
+	}
+}
+
+func TestQueueJobDoneAfterLastSet(t *testing.T) {
+	q := &Queue{}
+	job := newQueueJob()
+	for i := 0; i < 3; i++ {
+		q.add(job, queuePageOf(1))
+	}
+
+	taken := []*ZipImage{}
+	for i := 0; i < 3; i++ {
+		taken = append(taken, q.take(ownerLocal))
+	}
+	q.Set(ownerLocal, taken[0])
+	q.listed(job)
+	q.Set(ownerLocal, taken[2])
+	if returnsWithin(job.done) {
+		t.Fatal("job done with a page still being hashed")
+	}
+
+	taken[1].Hashes = map[string]uint64{HashAverage: 5}
+	q.Set(ownerLocal, taken[1])
+	if !returnsWithin(job.done) {
+		t.Fatal("job not done after last set")
+	}
+	if !job.images[1].Parsed || job.images[1].Hashes[HashAverage] != 5 || job.images[1].Data != nil {
+		t.Errorf("page not set, got %+v", job.images[1])
+	}
+	if q.held != 0 {
+		t.Errorf("held %d bytes after every page is set", q.held)
+	}
+}
+
+func TestQueueJobNotDoneBeforeListed(t *testing.T) {
+	q := &Queue{}
+	job := newQueueJob()
+	q.add(job, queuePageOf(1))
+	q.Set(ownerLocal, q.take(ownerLocal))
+	if returnsWithin(job.done) {
+		t.Fatal("job done before every page is queued")
+	}
+	q.listed(job)
+	if !returnsWithin(job.done) {
+		t.Fatal("job not done once listed")
+	}
+}
+
+func TestQueueStopReleasesWaiters(t *testing.T) {
+	q := &Queue{}
+	q.setBudget(10)
+	job := newQueueJob()
+	q.add(job, queuePageOf(8))
+	q.take(ownerLocal)
+
+	// producer waiting on budget, thread waiting on pages
+	added := make(chan bool, 1)
+	go func() {
+		added <- q.add(job, queuePageOf(8))
+	}()
+	took := make(chan *ZipImage, 1)
+	go func() {
+		took <- q.take(ownerLocal)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	q.stop()
+	select {
+	case ok := <-added:
+		if ok {
+			t.Error("page added after stop")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("producer still blocked after stop")
+	}
+	select {
+	case zi := <-took:
+		if zi != nil {
+			t.Error("page taken after stop")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("thread still blocked after stop")
+	}
+	if q.add(job, queuePageOf(1)) {
+		t.Error("page added to stopped queue")
+	}
+}
+
+func TestQueueReleaseRequeuesLentPages(t *testing.T) {
+	q := &Queue{}
+	job := newQueueJob()
+	for i := 0; i < 3; i++ {
+		q.add(job, queuePageOf(4))
+	}
+	q.listed(job)
+
+	// client 1 takes two pages and disconnects
+	first := q.take(1)
+	second := q.take(1)
+	q.Release(1)
+
+	if zi := q.GetNext(1); zi.Inode != -1 {
+		t.Errorf("page lent to released client")
+	}
+	if err := q.Set(1, first); err == nil {
+		t.Error("late result of released client accepted")
+	}
+
+	// client 2 gets the requeued pages first, in queue order
+	for _, want := range []uint64{first.QID, second.QID, 3} {
+		zi := q.GetNext(2)
+		if zi.QID != want {
+			t.Fatalf("got page %d, want %d", zi.QID, want)
+		}
+		if len(zi.Data) != 4 {
+			t.Fatalf("requeued page %d lost its data", zi.QID)
+		}
+		if err := q.Set(2, zi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !returnsWithin(job.done) {
+		t.Fatal("job not done after requeued pages are set")
+	}
+}
+
+func TestQueueReleaseWakesWaitingClient(t *testing.T) {
+	q := &Queue{}
+	got := make(chan *ZipImage, 1)
+	go func() {
+		got <- q.GetNext(1)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	q.Release(1)
+	select {
+	case zi := <-got:
+		if zi.Inode != -1 {
+			t.Error("released client got a page")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("released client still waiting for a page")
+	}
+}
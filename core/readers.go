@@ -0,0 +1,652 @@
+package core
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/bodgit/sevenzip"
+	"github.com/ninja-software/terror"
+	"github.com/nwaples/rardecode/v2"
+	"github.com/ulikunitz/xz"
+)
+
+// builtin archive readers
+
+// compression magic bytes for cbt archives
+var (
+	magicGzip  = []byte{0x1f, 0x8b}
+	magicBzip2 = []byte("BZh")
+	magicXz    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+func init() {
+	formats := []*ArchiveFormat{
+		{
+			Name:  "cbz",
+			Ext:   reFileExtCBZ,
+			Magic: hasMagic(0, []byte("PK\x03\x04")),
+			Open:  openZip,
+		},
+		{
+			Name:  "cbr",
+			Ext:   reFileExtCBR,
+			Magic: hasMagic(0, []byte("Rar!\x1a\x07")),
+			Open:  openRar,
+		},
+		{
+			Name:  "cbt",
+			Ext:   reFileExtCBT,
+			Magic: hasMagic(257, []byte("ustar")),
+			Open:  openTar,
+		},
+		{
+			Name:  "cb7",
+			Ext:   reFileExtCB7,
+			Magic: hasMagic(0, []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}),
+			Open:  open7z,
+		},
+	}
+	for _, af := range formats {
+		err := RegisterArchiveFormat(af)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// dirReader reads image dir as virtual archive, ordered by file name.
+// crc32 is calculated from the image data
+type dirReader struct {
+	dir string
+}
+
+func openDir(dir string) (ArchiveReader, error) {
+	return &dirReader{dir: dir}, nil
+}
+
+func (r *dirReader) Walk(fn func(e *ArchiveEntry) error) error {
+	fis, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return terror.New(err, "")
+	}
+
+	for _, fi := range fis {
+		if fi.IsDir() || !isImage(fi.Name()) {
+			continue
+		}
+
+		fdat, err := ioutil.ReadFile(filepath.Join(r.dir, fi.Name()))
+		if err != nil {
+			return terror.New(err, "")
+		}
+
+		err = fn(&ArchiveEntry{
+			Name:  fi.Name(),
+			CRC32: crc32.ChecksumIEEE(fdat),
+			Size:  uint64(len(fdat)),
+			Data:  fdat,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *dirReader) Close() error {
+	return nil
+}
+
+// zipReader reads cbz archive
+type zipReader struct {
+	r *zip.ReadCloser
+}
+
+func openZip(file string) (ArchiveReader, error) {
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		return nil, terror.New(err, "")
+	}
+	return &zipReader{r: r}, nil
+}
+
+func (r *zipReader) Walk(fn func(e *ArchiveEntry) error) error {
+	for _, f := range r.r.File {
+		if !isImage(f.Name) {
+			continue
+		}
+
+		fp, err := f.Open()
+		if err != nil {
+			return terror.New(err, "")
+		}
+		fdat, err := ioutil.ReadAll(fp)
+		fp.Close()
+		if err != nil {
+			return terror.New(err, "")
+		}
+
+		err = fn(&ArchiveEntry{
+			Name:  f.Name,
+			CRC32: f.CRC32,
+			Size:  f.UncompressedSize64,
+			Data:  fdat,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List image entries from the central directory
+func (r *zipReader) List(fn func(e *ArchiveEntry) error) error {
+	for _, f := range r.r.File {
+		if !isImage(f.Name) {
+			continue
+		}
+		err := fn(&ArchiveEntry{
+			Name:  f.Name,
+			CRC32: f.CRC32,
+			Size:  f.UncompressedSize64,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *zipReader) Close() error {
+	return r.r.Close()
+}
+
+// rarReader reads cbr archive.
+// rardecode does not expose crc32, so it is calculated from the image data
+type rarReader struct {
+	r    *rardecode.ReadCloser
+	file string
+}
+
+func openRar(file string) (ArchiveReader, error) {
+	r, err := rardecode.OpenReader(file)
+	if err != nil {
+		return nil, terror.New(err, "")
+	}
+	return &rarReader{r: r, file: file}, nil
+}
+
+func (r *rarReader) Walk(fn func(e *ArchiveEntry) error) error {
+	for {
+		h, err := r.r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return terror.New(err, "")
+		}
+		if h.IsDir || !isImage(h.Name) {
+			continue
+		}
+
+		fdat, err := ioutil.ReadAll(r.r)
+		if err != nil {
+			return terror.New(err, "")
+		}
+
+		err = fn(&ArchiveEntry{
+			Name:  h.Name,
+			CRC32: crc32.ChecksumIEEE(fdat),
+			Size:  uint64(len(fdat)),
+			Data:  fdat,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List image entries from the file headers, names by rardecode and crc32 read from the headers.
+// archives whose headers cannot be read this way are read through
+func (r *rarReader) List(fn func(e *ArchiveEntry) error) error {
+	heads, err := readRarHeaders(r.file)
+	var files []*rardecode.File
+	if err == nil {
+		files, err = rardecode.List(r.file)
+	}
+	if err == nil && len(files) != len(heads) {
+		err = errRarHeaders
+	}
+	for i := 0; err == nil && i < len(files); i++ {
+		if files[i].IsDir != heads[i].dir || (!files[i].IsDir && uint64(files[i].UnPackedSize) != heads[i].size) {
+			err = errRarHeaders
+		}
+	}
+	if err != nil {
+		return r.Walk(fn)
+	}
+
+	for i, f := range files {
+		if f.IsDir || !isImage(f.Name) {
+			continue
+		}
+		err := fn(&ArchiveEntry{
+			Name:  f.Name,
+			CRC32: heads[i].crc,
+			Size:  heads[i].size,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *rarReader) Close() error {
+	return r.r.Close()
+}
+
+// rar signatures of rar 1.5-4.x and rar 5
+var (
+	rarSignature4 = []byte("Rar!\x1a\x07\x00")
+	rarSignature5 = []byte("Rar!\x1a\x07\x01\x00")
+)
+
+// errRarHeaders rar file headers not readable without rardecode, e.g. encrypted, multi volume or without crc32
+var errRarHeaders = errors.New("rar headers not readable")
+
+// rarHeader file header of rar archive
+type rarHeader struct {
+	dir  bool
+	size uint64 // unpacked size
+	crc  uint32 // crc32 of unpacked data
+}
+
+// readRarHeaders file headers of rar archive in archive order, skipping the packed data
+func readRarHeaders(file string) ([]*rarHeader, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sig := make([]byte, len(rarSignature5))
+	_, err = io.ReadFull(f, sig)
+	if err != nil {
+		return nil, errRarHeaders
+	}
+	switch {
+	case bytes.HasPrefix(sig, rarSignature5):
+		return readRar5Headers(f, int64(len(rarSignature5)))
+	case bytes.HasPrefix(sig, rarSignature4):
+		return readRar4Headers(f, int64(len(rarSignature4)))
+	}
+	return nil, errRarHeaders
+}
+
+// readAtMost read up to n bytes at off, fewer at end of file
+func readAtMost(f io.ReaderAt, off int64, n int) ([]byte, error) {
+	b := make([]byte, n)
+	m, err := f.ReadAt(b, off)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return b[:m], nil
+}
+
+// readRar4Headers file headers of rar 1.5-4.x blocks from off
+func readRar4Headers(f io.ReaderAt, off int64) ([]*rarHeader, error) {
+	heads := []*rarHeader{}
+	for {
+		b, err := readAtMost(f, off, 7)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) == 0 {
+			// no end of archive block
+			return heads, nil
+		}
+		if len(b) < 7 {
+			return nil, errRarHeaders
+		}
+		typ := b[2]
+		flags := binary.LittleEndian.Uint16(b[3:])
+		size := int(binary.LittleEndian.Uint16(b[5:]))
+		if size < 7 {
+			return nil, errRarHeaders
+		}
+		b, err = readAtMost(f, off, size)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) < size {
+			return nil, errRarHeaders
+		}
+
+		// data following the header
+		data := uint64(0)
+		if flags&0x8000 != 0 {
+			if size < 11 {
+				return nil, errRarHeaders
+			}
+			data = uint64(binary.LittleEndian.Uint32(b[7:]))
+		}
+
+		switch typ {
+		case 0x73:
+			// main header, volume or encrypted headers
+			if flags&0x0081 != 0 {
+				return nil, errRarHeaders
+			}
+		case 0x74:
+			// file header, split across volumes has partial crc32
+			if size < 32 || flags&0x0003 != 0 {
+				return nil, errRarHeaders
+			}
+			h := &rarHeader{
+				dir:  flags&0x00e0 == 0x00e0,
+				size: uint64(binary.LittleEndian.Uint32(b[11:])),
+				crc:  binary.LittleEndian.Uint32(b[16:]),
+			}
+			if flags&0x0100 != 0 {
+				// large file, high 32 bits of packed and unpacked size
+				if size < 40 {
+					return nil, errRarHeaders
+				}
+				data |= uint64(binary.LittleEndian.Uint32(b[32:])) << 32
+				h.size |= uint64(binary.LittleEndian.Uint32(b[36:])) << 32
+			}
+			heads = append(heads, h)
+		case 0x7b:
+			// end of archive
+			return heads, nil
+		}
+
+		off += int64(size) + int64(data)
+	}
+}
+
+// rarVint rar 5 variable length integer at the start of b, with its length. length 0 if invalid
+func rarVint(b []byte) (uint64, int) {
+	v := uint64(0)
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// readRar5Headers file headers of rar 5 blocks from off
+func readRar5Headers(f io.ReaderAt, off int64) ([]*rarHeader, error) {
+	heads := []*rarHeader{}
+	for {
+		b, err := readAtMost(f, off, 4+3)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) == 0 {
+			// no end of archive header
+			return heads, nil
+		}
+		size, n := rarVint(b[min(4, len(b)):])
+		if n == 0 || size == 0 || size > 2<<20 {
+			return nil, errRarHeaders
+		}
+		start := off + 4 + int64(n)
+		b, err = readAtMost(f, start, int(size))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) < int(size) {
+			return nil, errRarHeaders
+		}
+
+		// type, flags, extra area size and data size
+		i := 0
+		next := func() uint64 {
+			v, n := rarVint(b[min(i, len(b)):])
+			if n == 0 {
+				err = errRarHeaders
+			}
+			i += n
+			return v
+		}
+		typ := next()
+		flags := next()
+		if flags&0x0001 != 0 {
+			next()
+		}
+		data := uint64(0)
+		if flags&0x0002 != 0 {
+			data = next()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch typ {
+		case 1:
+			// main header, volume
+			if next()&0x0001 != 0 || err != nil {
+				return nil, errRarHeaders
+			}
+		case 2:
+			// file header, split across volumes has partial crc32
+			if flags&0x0018 != 0 {
+				return nil, errRarHeaders
+			}
+			fflags := next()
+			h := &rarHeader{
+				dir:  fflags&0x0001 != 0,
+				size: next(),
+			}
+			next() // attributes
+			if fflags&0x0002 != 0 {
+				i += 4 // modified time
+			}
+			if !h.dir {
+				// crc32 of data, files hashed by blake2 only are read through
+				if fflags&0x0004 == 0 || i+4 > len(b) {
+					return nil, errRarHeaders
+				}
+				h.crc = binary.LittleEndian.Uint32(b[i:])
+			}
+			if err != nil {
+				return nil, err
+			}
+			heads = append(heads, h)
+		case 4:
+			// encrypted headers
+			return nil, errRarHeaders
+		case 5:
+			// end of archive
+			return heads, nil
+		}
+
+		off = start + int64(size) + int64(data)
+	}
+}
+
+// tarReader reads cbt archive, optionally gzip, bzip2 or xz compressed.
+// tar does not store crc32, so it is calculated from the image data
+type tarReader struct {
+	f *os.File
+	r *tar.Reader
+}
+
+func openTar(file string) (ArchiveReader, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, terror.New(err, "")
+	}
+
+	// detect compression by magic bytes
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(len(magicXz))
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, terror.New(err, "")
+	}
+
+	var rd io.Reader = br
+	switch {
+	case bytes.HasPrefix(magic, magicGzip):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, terror.New(err, "")
+		}
+		rd = gz
+	case bytes.HasPrefix(magic, magicBzip2):
+		rd = bzip2.NewReader(br)
+	case bytes.HasPrefix(magic, magicXz):
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, terror.New(err, "")
+		}
+		rd = xr
+	}
+
+	return &tarReader{f: f, r: tar.NewReader(rd)}, nil
+}
+
+func (r *tarReader) Walk(fn func(e *ArchiveEntry) error) error {
+	for {
+		h, err := r.r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return terror.New(err, "")
+		}
+		if h.Typeflag != tar.TypeReg || !isImage(h.Name) {
+			continue
+		}
+
+		fdat, err := ioutil.ReadAll(r.r)
+		if err != nil {
+			return terror.New(err, "")
+		}
+
+		err = fn(&ArchiveEntry{
+			Name:  h.Name,
+			CRC32: crc32.ChecksumIEEE(fdat),
+			Size:  uint64(len(fdat)),
+			Data:  fdat,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *tarReader) Close() error {
+	return r.f.Close()
+}
+
+// sevenZipReader reads cb7 archive.
+// crc32 is calculated from the image data when the archive does not store it
+type sevenZipReader struct {
+	r *sevenzip.ReadCloser
+}
+
+func open7z(file string) (ArchiveReader, error) {
+	r, err := sevenzip.OpenReader(file)
+	if err != nil {
+		return nil, terror.New(err, "")
+	}
+	return &sevenZipReader{r: r}, nil
+}
+
+func (r *sevenZipReader) Walk(fn func(e *ArchiveEntry) error) error {
+	for _, f := range r.r.File {
+		if f.FileInfo().IsDir() || !isImage(f.Name) {
+			continue
+		}
+
+		fp, err := f.Open()
+		if err != nil {
+			return terror.New(err, "")
+		}
+		fdat, err := ioutil.ReadAll(fp)
+		fp.Close()
+		if err != nil {
+			return terror.New(err, "")
+		}
+
+		crc := f.CRC32
+		if crc == 0 {
+			crc = crc32.ChecksumIEEE(fdat)
+		}
+
+		err = fn(&ArchiveEntry{
+			Name:  f.Name,
+			CRC32: crc,
+			Size:  uint64(len(fdat)),
+			Data:  fdat,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List image entries from the archive header, data is only read for files stored without crc32
+func (r *sevenZipReader) List(fn func(e *ArchiveEntry) error) error {
+	for _, f := range r.r.File {
+		if f.FileInfo().IsDir() || !isImage(f.Name) {
+			continue
+		}
+
+		crc := f.CRC32
+		if crc == 0 && f.UncompressedSize > 0 {
+			fp, err := f.Open()
+			if err != nil {
+				return terror.New(err, "")
+			}
+			h := crc32.NewIEEE()
+			_, err = io.Copy(h, fp)
+			fp.Close()
+			if err != nil {
+				return terror.New(err, "")
+			}
+			crc = h.Sum32()
+		}
+
+		err := fn(&ArchiveEntry{
+			Name:  f.Name,
+			CRC32: crc,
+			Size:  f.UncompressedSize,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *sevenZipReader) Close() error {
+	return r.r.Close()
+}
@@ -0,0 +1,383 @@
+package core
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/nwaples/rardecode/v2"
+	"github.com/ulikunitz/xz"
+)
+
+// testEntry archive entry to write, dir if data is nil
+type testEntry struct {
+	name string
+	data []byte
+}
+
+// testPages entries of test archives, in archive order with a dir and a non image
+var testPages = []testEntry{
+	{"2.png", []byte("page two")},
+	{"notes.txt", []byte("not a page")},
+	{"1.png", []byte("page one")},
+	{"sub", nil},
+	{"sub/3.jpg", []byte("page three")},
+}
+
+// wantPages image entries of testPages, in archive order
+func wantPages() []*ArchiveEntry {
+	entries := []*ArchiveEntry{}
+	for _, e := range testPages {
+		if e.data == nil || !isImage(e.name) {
+			continue
+		}
+		entries = append(entries, &ArchiveEntry{
+			Name:  e.name,
+			CRC32: crc32.ChecksumIEEE(e.data),
+			Size:  uint64(len(e.data)),
+			Data:  e.data,
+		})
+	}
+	return entries
+}
+
+// withoutData entries as listed, without image data
+func withoutData(entries []*ArchiveEntry) []*ArchiveEntry {
+	listed := []*ArchiveEntry{}
+	for _, e := range entries {
+		listed = append(listed, &ArchiveEntry{Name: e.Name, CRC32: e.CRC32, Size: e.Size})
+	}
+	return listed
+}
+
+// writeRar4 write rar 1.5-4.x archive of stored entries
+func writeRar4(t *testing.T, file string, entries []testEntry) {
+	b := &bytes.Buffer{}
+	b.Write(rarSignature4)
+
+	block := func(h []byte) {
+		binary.LittleEndian.PutUint16(h[0:], uint16(crc32.ChecksumIEEE(h[2:])))
+		b.Write(h)
+	}
+	block([]byte{0, 0, 0x73, 0, 0, 13, 0, 0, 0, 0, 0, 0, 0})
+
+	for _, e := range entries {
+		h := make([]byte, 32, 32+len(e.name))
+		h[2] = 0x74
+		flags := uint16(0x8000)
+		if e.data == nil {
+			flags |= 0x00e0
+		}
+		binary.LittleEndian.PutUint16(h[3:], flags)
+		binary.LittleEndian.PutUint16(h[5:], uint16(32+len(e.name)))
+		binary.LittleEndian.PutUint32(h[7:], uint32(len(e.data)))
+		binary.LittleEndian.PutUint32(h[11:], uint32(len(e.data)))
+		binary.LittleEndian.PutUint32(h[16:], crc32.ChecksumIEEE(e.data))
+		h[24] = 29   // unpack version
+		h[25] = 0x30 // stored
+		binary.LittleEndian.PutUint16(h[26:], uint16(len(e.name)))
+		h = append(h, e.name...)
+		block(h)
+		b.Write(e.data)
+	}
+	block([]byte{0, 0, 0x7b, 0, 0x40, 7, 0})
+
+	if err := os.WriteFile(file, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rarVintBytes rar 5 variable length integer
+func rarVintBytes(v uint64) []byte {
+	b := []byte{}
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// writeRar5 write rar 5 archive of stored entries
+func writeRar5(t *testing.T, file string, entries []testEntry) {
+	b := &bytes.Buffer{}
+	b.Write(rarSignature5)
+
+	block := func(fields ...[]byte) {
+		h := rarVintBytes(uint64(len(bytes.Join(fields, nil))))
+		h = append(h, bytes.Join(fields, nil)...)
+		crc := make([]byte, 4)
+		binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(h))
+		b.Write(crc)
+		b.Write(h)
+	}
+	v := rarVintBytes
+	block(v(1), v(0), v(0))
+
+	for _, e := range entries {
+		if e.data == nil {
+			block(v(2), v(0), v(0x0001), v(0), v(0), v(0), v(0), v(uint64(len(e.name))), []byte(e.name))
+			continue
+		}
+		crc := make([]byte, 4)
+		binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(e.data))
+		size := v(uint64(len(e.data)))
+		block(v(2), v(0x0002), size, v(0x0004), size, v(0), crc, v(0), v(1), v(uint64(len(e.name))), []byte(e.name))
+		b.Write(e.data)
+	}
+	block(v(5), v(0), v(0))
+
+	if err := os.WriteFile(file, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// copyTestdata copy file of testdata into dir under name
+func copyTestdata(t *testing.T, file, dir, name string) string {
+	b, err := os.ReadFile(filepath.Join("testdata", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := filepath.Join(dir, name)
+	if err := os.WriteFile(to, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return to
+}
+
+// walkEntries entries read by Walk of the archive reader
+func walkEntries(t *testing.T, file string) []*ArchiveEntry {
+	entries := []*ArchiveEntry{}
+	err := readArchive(file, func(e *ArchiveEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%s: %v", filepath.Base(file), err)
+	}
+	return entries
+}
+
+func TestListMatchesWalkWithoutData(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{
+		copyTestdata(t, "pages.7z", dir, "a.cb7"),
+		filepath.Join(dir, "a.cbr"),
+		filepath.Join(dir, "a5.cbr"),
+	}
+	writeRar4(t, files[1], testPages)
+	writeRar5(t, files[2], testPages)
+
+	for _, file := range files {
+		r, err := OpenArchive(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, ok := r.(entryLister)
+		r.Close()
+		if !ok {
+			t.Errorf("%s: reader does not list entries", filepath.Base(file))
+		}
+
+		listed, err := listArchiveEntries(file)
+		if err != nil {
+			t.Fatalf("%s: %v", filepath.Base(file), err)
+		}
+		want := withoutData(wantPages())
+		if !reflect.DeepEqual(listed, want) {
+			t.Errorf("%s: listed %v, want %v", filepath.Base(file), listed, want)
+		}
+		if !reflect.DeepEqual(listed, withoutData(walkEntries(t, file))) {
+			t.Errorf("%s: listed entries differ from walk", filepath.Base(file))
+		}
+	}
+}
+
+func TestReadRarHeaders(t *testing.T) {
+	dir := t.TempDir()
+	want := []*rarHeader{}
+	for _, e := range testPages {
+		want = append(want, &rarHeader{dir: e.data == nil, size: uint64(len(e.data)), crc: crc32.ChecksumIEEE(e.data)})
+	}
+
+	for name, write := range map[string]func(*testing.T, string, []testEntry){"rar4": writeRar4, "rar5": writeRar5} {
+		file := filepath.Join(dir, name+".cbr")
+		write(t, file, testPages)
+		heads, err := readRarHeaders(file)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(heads, want) {
+			t.Errorf("%s: headers %+v, want %+v", name, heads, want)
+		}
+		// lined up with rardecode file list, else listing reads through
+		files, err := rardecode.List(file)
+		if err != nil || len(files) != len(heads) {
+			t.Fatalf("%s: rardecode listed %d files, %v", name, len(files), err)
+		}
+		for i, f := range files {
+			if f.Name != testPages[i].name || f.IsDir != heads[i].dir {
+				t.Errorf("%s: rardecode file %d %s, want %s", name, i, f.Name, testPages[i].name)
+			}
+		}
+
+		// truncated headers are read through instead
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, b[:len(rarSignature5)+6], 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readRarHeaders(file); err == nil {
+			t.Errorf("%s: truncated headers read", name)
+		}
+	}
+}
+
+// writeZipEntries write zip archive of entries
+func writeZipEntries(t *testing.T, file string, entries []testEntry) {
+	b := &bytes.Buffer{}
+	zw := zip.NewWriter(b)
+	for _, e := range entries {
+		name := e.name
+		if e.data == nil {
+			name += "/"
+		}
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(e.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTarEntries write tar archive of entries, compressed by gzip or xz if set
+func writeTarEntries(t *testing.T, file string, entries []testEntry, compress string) {
+	b := &bytes.Buffer{}
+	var w io.WriteCloser = nopWriteCloser{b}
+	switch compress {
+	case "gzip":
+		w = gzip.NewWriter(b)
+	case "xz":
+		xw, err := xz.NewWriter(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = xw
+	}
+
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.data)), Typeflag: tar.TypeReg}
+		if e.data == nil {
+			h.Name += "/"
+			h.Mode = 0755
+			h.Typeflag = tar.TypeDir
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(e.data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func TestArchiveReaders(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name  string
+		write func(file string)
+	}{
+		{"a.cbz", func(file string) { writeZipEntries(t, file, testPages) }},
+		{"a.cbr", func(file string) { writeRar4(t, file, testPages) }},
+		{"a5.cbr", func(file string) { writeRar5(t, file, testPages) }},
+		{"a.cbt", func(file string) { writeTarEntries(t, file, testPages, "") }},
+		{"gz.cbt", func(file string) { writeTarEntries(t, file, testPages, "gzip") }},
+		{"xz.cbt", func(file string) { writeTarEntries(t, file, testPages, "xz") }},
+		{"bz2.cbt", func(file string) { copyTestdata(t, "pages.tar.bz2", dir, "bz2.cbt") }},
+		{"a.cb7", func(file string) { copyTestdata(t, "pages.7z", dir, "a.cb7") }},
+		// mislabeled, opened by magic bytes
+		{"zip.cbr", func(file string) { writeZipEntries(t, file, testPages) }},
+		{"rar.cbz", func(file string) { writeRar4(t, file, testPages) }},
+		{"tar.cb7", func(file string) { writeTarEntries(t, file, testPages, "") }},
+		{"7z.cbz", func(file string) { copyTestdata(t, "pages.7z", dir, "7z.cbz") }},
+	}
+
+	for _, tt := range tests {
+		file := filepath.Join(dir, tt.name)
+		tt.write(file)
+
+		got := walkEntries(t, file)
+		if !reflect.DeepEqual(got, wantPages()) {
+			t.Errorf("%s: entries %v, want %v", tt.name, withoutData(got), withoutData(wantPages()))
+		}
+	}
+}
+
+func TestDirReaderOrderedByName(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "chapter")
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range testPages {
+		if e.data == nil {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dir, e.name), e.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// images directly inside the dir, by name
+	pages := wantPages()
+	want := []*ArchiveEntry{pages[1], pages[0]}
+	if got := walkEntries(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("entries %v, want %v", withoutData(got), withoutData(want))
+	}
+}
+
+func TestOpenArchiveUnknownFormat(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "a.cbz"} {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte("not an archive"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		r, err := OpenArchive(file)
+		if err == nil {
+			r.Close()
+			t.Errorf("%s: opened", name)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package core
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ninja-software/terror"
+)
+
+// machine readable check results
+
+// check result formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+// StatusOut where progress messages go, stderr when results are machine readable
+func (opts CheckOptions) StatusOut() io.Writer {
+	if opts.Format == FormatJSON || opts.Format == FormatCSV {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// ReportArchive archive of a duplicate group
+type ReportArchive struct {
+	Dev   uint64 `json:"dev"`
+	Inode int64  `json:"inode"`
+	Path  string `json:"path"`
+	Pages int    `json:"pages"`
+}
+
+// ReportPair matched pages of head and member, page numbers 1 based
+type ReportPair struct {
+	Head     int    `json:"head"`
+	Member   int    `json:"member"`
+	HeadName string `json:"headName"`
+	Name     string `json:"name"`
+	Dist     int    `json:"dist"` // hamming distance by hash algorithm
+}
+
+// ReportMember duplicate of group head with its match to head
+type ReportMember struct {
+	ReportArchive
+	Score   int           `json:"score"`   // shared images on exact match, similar image pairs otherwise
+	Matched int           `json:"matched"` // pages matched with head
+	Pairs   []*ReportPair `json:"pairs"`
+}
+
+// ReportGroup duplicate group, head is the archive to keep
+type ReportGroup struct {
+	Group   int             `json:"group"`
+	Head    ReportArchive   `json:"head"`
+	Members []*ReportMember `json:"members"`
+}
+
+func reportArchive(archive *Archive) ReportArchive {
+	return ReportArchive{
+		Dev:   archive.Dev,
+		Inode: archive.Inode,
+		Path:  archive.Name,
+		Pages: len(archive.Images),
+	}
+}
+
+// matchScore score of archive against head as used by check
+func matchScore(head, archive *Archive) int {
+	if exactMatch {
+		index := buildExactIndex(Archives{archive})
+		return index.sharedImages(head)[0]
+	}
+	return similarScore(similarImages(head, true), archive)
+}
+
+// reportGroups detail duplicate groups with scores and matched pages of every member against head
+func reportGroups(groups DupArchives) []*ReportGroup {
+	reports := []*ReportGroup{}
+	for n, dup := range groups {
+		report := &ReportGroup{
+			Group:   n + 1,
+			Head:    reportArchive(dup.Head),
+			Members: []*ReportMember{},
+		}
+		for _, d := range dup.Dups {
+			cmp := compareArchives(dup.Head, d)
+			member := &ReportMember{
+				ReportArchive: reportArchive(d),
+				Score:         matchScore(dup.Head, d),
+				Matched:       cmp.Matched,
+				Pairs:         []*ReportPair{},
+			}
+			for _, p := range cmp.Pairs {
+				if !p.Matched() {
+					continue
+				}
+				member.Pairs = append(member.Pairs, &ReportPair{
+					Head:     p.NA,
+					Member:   p.NB,
+					HeadName: p.A.Name,
+					Name:     p.B.Name,
+					Dist:     p.Dist,
+				})
+			}
+			report.Members = append(report.Members, member)
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// writeDupsJSON write duplicate groups as json
+func writeDupsJSON(w io.Writer, groups DupArchives) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(reportGroups(groups))
+	if err != nil {
+		return terror.New(err, "")
+	}
+	return nil
+}
+
+// writeDupsCSV write duplicate groups as csv, one row per archive, head row first.
+// pairs are space separated head:member:dist page numbers
+func writeDupsCSV(w io.Writer, groups DupArchives) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"group", "role", "dev", "inode", "path", "pages", "score", "matched", "pairs"})
+
+	for _, report := range reportGroups(groups) {
+		group := strconv.Itoa(report.Group)
+		cw.Write([]string{
+			group, "head",
+			strconv.FormatUint(report.Head.Dev, 10),
+			strconv.FormatInt(report.Head.Inode, 10),
+			report.Head.Path,
+			strconv.Itoa(report.Head.Pages),
+			"", "", "",
+		})
+		for _, m := range report.Members {
+			pairs := []string{}
+			for _, p := range m.Pairs {
+				pairs = append(pairs, fmt.Sprintf("%d:%d:%d", p.Head, p.Member, p.Dist))
+			}
+			cw.Write([]string{
+				group, "member",
+				strconv.FormatUint(m.Dev, 10),
+				strconv.FormatInt(m.Inode, 10),
+				m.Path,
+				strconv.Itoa(m.Pages),
+				strconv.Itoa(m.Score),
+				strconv.Itoa(m.Matched),
+				strings.Join(pairs, " "),
+			})
+		}
+	}
+
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return terror.New(err, "")
+	}
+	return nil
+}
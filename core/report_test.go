@@ -0,0 +1,63 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// reportDups one group, head and a member sharing 4 of 5 pages, one page off by a bit
+func reportDups() DupArchives {
+	head := testArchive(1, []uint64{0x0, 0xffff, 0xffff0000, 0xff00ff00, 0xf0f0f0f0})
+	member := testArchive(2, []uint64{0x0, 0xffff ^ 0x1, 0xffff0000, 0xff00ff00, 0xffffffff00000000})
+	return DupArchives{{Head: head, Dups: []*Archive{member}}}
+}
+
+func TestWriteDupsJSON(t *testing.T) {
+	setCheckOptions(CheckOptions{MaxImageDist: 3, MaxArchiveDiff: 10, HashAlgo: HashAverage})
+	out := &bytes.Buffer{}
+	if err := writeDupsJSON(out, reportDups()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `[{"group":1,` +
+		`"head":{"dev":1,"inode":1,"path":"/lib/b.cbz","pages":5},` +
+		`"members":[{"dev":1,"inode":2,"path":"/lib/c.cbz","pages":5,"score":3,"matched":4,"pairs":[` +
+		`{"head":1,"member":1,"headName":"a.png","name":"a.png","dist":0},` +
+		`{"head":2,"member":2,"headName":"b.png","name":"b.png","dist":1},` +
+		`{"head":3,"member":3,"headName":"c.png","name":"c.png","dist":0},` +
+		`{"head":4,"member":4,"headName":"d.png","name":"d.png","dist":0}]}]}]`
+	got := &bytes.Buffer{}
+	if err := json.Compact(got, out.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != want {
+		t.Errorf("json\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteDupsJSONNoGroups(t *testing.T) {
+	out := &bytes.Buffer{}
+	if err := writeDupsJSON(out, DupArchives{}); err != nil {
+		t.Fatal(err)
+	}
+	// empty list, not null
+	if out.String() != "[]\n" {
+		t.Errorf("json %q, want []", out.String())
+	}
+}
+
+func TestWriteDupsCSV(t *testing.T) {
+	setCheckOptions(CheckOptions{MaxImageDist: 3, MaxArchiveDiff: 10, HashAlgo: HashAverage})
+	out := &bytes.Buffer{}
+	if err := writeDupsCSV(out, reportDups()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "group,role,dev,inode,path,pages,score,matched,pairs\n" +
+		"1,head,1,1,/lib/b.cbz,5,,,\n" +
+		"1,member,1,2,/lib/c.cbz,5,3,4,1:1:0 2:2:1 3:3:0 4:4:0\n"
+	if out.String() != want {
+		t.Errorf("csv\n%s\nwant\n%s", out, want)
+	}
+}
@@ -0,0 +1,430 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ninja-software/terror"
+)
+
+// remove duplicate archives into quarantine, with journal to undo
+
+// journalFile quarantine journal file name, inside quarantine dir
+const journalFile = "kagami_journal.jsonl"
+
+// journal operations
+const (
+	journalMove    = "move"
+	journalRestore = "restore"
+)
+
+// JournalEntry one archive move in quarantine journal
+type JournalEntry struct {
+	Op        string    `json:"op"`        // move or restore
+	Run       string    `json:"run"`       // rm run id
+	Group     int       `json:"group"`     // dup group number in run
+	Dev       uint64    `json:"dev"`       // archive device
+	Inode     int64     `json:"inode"`     // archive inode
+	From      string    `json:"from"`      // original archive path
+	To        string    `json:"to"`        // quarantined archive path
+	StoreFrom string    `json:"storeFrom"` // original store dir
+	StoreTo   string    `json:"storeTo"`   // quarantine store dir
+	Time      time.Time `json:"time"`
+}
+
+// RmDup move the duplicate archives of each group in store dir into quarantine, keeping the head.
+// paths relative to their scan dir are kept inside quarantine, under the scan dir name when there are several.
+// every move is written to the journal, dry run only lists what would be moved.
+// groups must be complete, so every archive moved matches the head directly.
+// archives the review marked keep or not duplicate are left in place
+func RmDup(dirs []string, storeDir, quarantine string, dryRun bool, opts CheckOptions) error {
+	if quarantine == "" {
+		return fmt.Errorf("quarantine must be specified")
+	}
+	err := checkQuarantine(dirs, quarantine)
+	if err != nil {
+		return terror.New(err, "")
+	}
+	if opts.Grouping != GroupComplete {
+		return fmt.Errorf("rm requires group %s, transitive groups can hold archives not matching the head", GroupComplete)
+	}
+
+	groups, err := loadDups(storeDir, opts)
+	if err != nil {
+		return terror.New(err, "")
+	}
+
+	review, err := loadReview(filepath.Join(storeDir, reviewFile))
+	if err != nil {
+		return terror.New(err, "")
+	}
+
+	return rmDup(groups, review, dirs, storeDir, quarantine, dryRun)
+}
+
+// reviewSkip review decision that keeps archive out of quarantine, empty if none.
+// decisions made on any group count, groups change with check options
+func reviewSkip(review *Review, archive *Archive) string {
+	if review == nil {
+		return ""
+	}
+	d := review.decision(archive)
+	if d == nil || (d.Decision != ReviewKeep && d.Decision != ReviewNotDup) {
+		return ""
+	}
+	return d.Decision
+}
+
+// resolvePath absolute path with symlinks resolved, path not yet existing is resolved from its nearest existing parent
+func resolvePath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return filepath.Join(path, rest), nil
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
+
+// checkQuarantine quarantine dir must be outside every scan dir, else quarantined archives are scanned again
+func checkQuarantine(dirs []string, quarantine string) error {
+	q, err := resolvePath(quarantine)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		d, err := resolvePath(dir)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(d, q)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("quarantine %s is inside scan dir %s", quarantine, dir)
+		}
+	}
+	return nil
+}
+
+// quarantinePath archive path relative to the scan dir holding it, prefixed by scan dir name when there are several
+func quarantinePath(dirs []string, file string) (string, bool) {
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(dir, file)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if len(dirs) > 1 {
+			rel = filepath.Join(filepath.Base(filepath.Clean(dir)), rel)
+		}
+		return rel, true
+	}
+	return "", false
+}
+
+func rmDup(groups DupArchives, review *Review, dirs []string, storeDir, quarantine string, dryRun bool) error {
+	var jf *os.File
+	if !dryRun {
+		err := os.MkdirAll(quarantine, 0755)
+		if err != nil {
+			return terror.New(err, "")
+		}
+
+		jf, err = os.OpenFile(filepath.Join(quarantine, journalFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return terror.New(err, "")
+		}
+		defer jf.Close()
+	}
+
+	// nanoseconds keep runs started within the same second apart
+	run := time.Now().Format("20060102-150405.000000000")
+	if dryRun {
+		fmt.Println("rm dry run")
+	} else {
+		fmt.Println("rm run", run)
+	}
+
+	moved := 0
+	for n, dup := range groups {
+		fmt.Printf("%d: keep (%s) %s\n", n+1, dup.Head.id(), dup.Head.Name)
+
+		for _, d := range dup.Dups {
+			if decision := reviewSkip(review, d); decision != "" {
+				fmt.Printf("  skip, reviewed %s: %s\n", decision, d.Name)
+				continue
+			}
+			rel, ok := quarantinePath(dirs, d.Name)
+			if !ok {
+				fmt.Printf("  skip, not in %s: %s\n", strings.Join(dirs, ", "), d.Name)
+				continue
+			}
+
+			entry := &JournalEntry{
+				Op:        journalMove,
+				Run:       run,
+				Group:     n + 1,
+				Dev:       d.Dev,
+				Inode:     d.Inode,
+				From:      d.Name,
+				To:        filepath.Join(quarantine, rel),
+				StoreFrom: storeDir,
+				StoreTo:   filepath.Join(quarantine, "store"),
+				Time:      time.Now(),
+			}
+
+			if dryRun {
+				fmt.Printf("  > would move (%s) %s to %s\n", d.id(), d.Name, entry.To)
+				moved++
+				continue
+			}
+
+			err := movePath(entry.From, entry.To)
+			if err != nil {
+				fmt.Printf("  err move %s: %v\n", d.Name, err)
+				continue
+			}
+			err = moveStoreRecord(entry.StoreFrom, entry.From, entry.StoreTo, entry.To)
+			if err != nil && !os.IsNotExist(err) {
+				fmt.Printf("  err move store %s: %v\n", entry.StoreFrom, err)
+			}
+
+			err = writeJournal(jf, entry)
+			if err != nil {
+				return terror.New(err, "")
+			}
+
+			fmt.Printf("  > moved (%s) %s\n", d.id(), d.Name)
+			moved++
+		}
+	}
+
+	if dryRun {
+		fmt.Printf("dry run, would move %d archives to %s\n", moved, quarantine)
+		return nil
+	}
+	fmt.Printf("moved %d archives to %s, run %s\n", moved, quarantine, run)
+	return nil
+}
+
+// Restore move archives of a quarantine run back to the original paths.
+// run is the last run if empty, group 0 restores every group of the run
+func Restore(quarantine, run string, group int) error {
+	entries, err := readJournal(filepath.Join(quarantine, journalFile))
+	if err != nil {
+		return terror.New(err, "")
+	}
+
+	if run == "" {
+		for _, e := range entries {
+			if e.Op == journalMove {
+				run = e.Run
+			}
+		}
+		if run == "" {
+			return fmt.Errorf("no rm run in journal")
+		}
+	}
+
+	// moves already restored
+	restored := map[string]bool{}
+	for _, e := range entries {
+		if e.Op == journalRestore {
+			restored[e.Run+"\x00"+e.To] = true
+		}
+	}
+
+	jf, err := os.OpenFile(filepath.Join(quarantine, journalFile), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return terror.New(err, "")
+	}
+	defer jf.Close()
+
+	fmt.Println("restore run", run)
+
+	count := 0
+	for _, e := range entries {
+		if e.Op != journalMove || e.Run != run {
+			continue
+		}
+		if group > 0 && e.Group != group {
+			continue
+		}
+		if restored[e.Run+"\x00"+e.To] {
+			continue
+		}
+
+		if fileExist(e.From) {
+			fmt.Printf("  skip, already exist: %s\n", e.From)
+			continue
+		}
+		err = movePath(e.To, e.From)
+		if err != nil {
+			fmt.Printf("  err restore %s: %v\n", e.From, err)
+			continue
+		}
+		err = moveStoreRecord(e.StoreTo, e.To, e.StoreFrom, e.From)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Printf("  err restore store %s: %v\n", e.StoreFrom, err)
+		}
+
+		restore := *e
+		restore.Op = journalRestore
+		restore.Time = time.Now()
+		err = writeJournal(jf, &restore)
+		if err != nil {
+			return terror.New(err, "")
+		}
+
+		fmt.Printf("  < restored (%d:%d) %s\n", e.Dev, e.Inode, e.From)
+		count++
+	}
+
+	fmt.Printf("restored %d archives\n", count)
+	return nil
+}
+
+func writeJournal(w io.Writer, entry *JournalEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return terror.New(err, "")
+	}
+	_, err = w.Write(append(b, '\n'))
+	if err != nil {
+		return terror.New(err, "")
+	}
+	return nil
+}
+
+func readJournal(file string) ([]*JournalEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, terror.New(err, "")
+	}
+	defer f.Close()
+
+	entries := []*JournalEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		entry := &JournalEntry{}
+		err = json.Unmarshal([]byte(line), entry)
+		if err != nil {
+			return nil, terror.New(err, "")
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, terror.New(err, "")
+	}
+
+	return entries, nil
+}
+
+// fileExist check if file or dir exist
+func fileExist(file string) bool {
+	_, err := os.Lstat(file)
+	return err == nil
+}
+
+// movePath move file or dir, copying across filesystems
+func movePath(from, to string) error {
+	if fileExist(to) {
+		return fmt.Errorf("destination exist %s", to)
+	}
+	err := os.MkdirAll(filepath.Dir(to), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(from, to)
+	if err == nil {
+		return nil
+	}
+	lerr, ok := err.(*os.LinkError)
+	if !ok || lerr.Err != syscall.EXDEV {
+		return err
+	}
+
+	// different filesystem, copy then remove
+	err = copyPath(from, to)
+	if err != nil {
+		os.RemoveAll(to)
+		return err
+	}
+	return os.RemoveAll(from)
+}
+
+// copyPath copy file or dir recursively, keeping mode and modified time
+func copyPath(from, to string) error {
+	info, err := os.Stat(from)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		err = os.MkdirAll(to, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(from)
+		if err != nil {
+			return err
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			err = copyPath(filepath.Join(from, name), filepath.Join(to, name))
+			if err != nil {
+				return err
+			}
+		}
+		return os.Chtimes(to, info.ModTime(), info.ModTime())
+	}
+
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(to, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	err = dst.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(to, info.ModTime(), info.ModTime())
+}
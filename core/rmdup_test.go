@@ -0,0 +1,184 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRmDupRequiresCompleteGrouping(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib")
+	err := RmDup([]string{lib}, filepath.Join(lib, "store"), filepath.Join(dir, "quarantine"), true, CheckOptions{Grouping: GroupSingle})
+	if err == nil || !strings.Contains(err.Error(), GroupComplete) {
+		t.Fatalf("expected error for single grouping, got %v", err)
+	}
+}
+
+func TestCheckQuarantineOutsideScanDirs(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib")
+	if err := os.MkdirAll(filepath.Join(lib, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(lib, "sub"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		quarantine string
+		inside     bool
+	}{
+		{filepath.Join(dir, "quarantine"), false},
+		{filepath.Join(dir, "lib2"), false},
+		{lib, true},
+		{filepath.Join(lib, "quarantine"), true},
+		{filepath.Join(lib, "sub", "..", "new", "quarantine"), true},
+		{filepath.Join(dir, "link", "quarantine"), true},
+	}
+	for _, tt := range tests {
+		err := checkQuarantine([]string{filepath.Join(dir, "other"), lib}, tt.quarantine)
+		if (err != nil) != tt.inside {
+			t.Errorf("%s: got error %v, inside %t", tt.quarantine, err, tt.inside)
+		}
+	}
+}
+
+func TestRmDupRunsWithinSecondApart(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib")
+	quarantine := filepath.Join(dir, "quarantine")
+	if err := os.MkdirAll(lib, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"b.cbz", "c.cbz"} {
+		if err := os.WriteFile(filepath.Join(lib, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		groups := DupArchives{{
+			Head: &Archive{Name: filepath.Join(lib, "a.cbz"), Dev: 1, Inode: 1},
+			Dups: []*Archive{{Name: filepath.Join(lib, name), Dev: 1, Inode: 2}},
+		}}
+		if err := rmDup(groups, nil, []string{lib}, filepath.Join(lib, "store"), quarantine, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := readJournal(filepath.Join(quarantine, journalFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Run == entries[1].Run {
+		t.Fatalf("expected 2 moves of different runs, got %d entries", len(entries))
+	}
+}
+
+func TestRmDupDryRunMovesNothing(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib")
+	quarantine := filepath.Join(dir, "quarantine")
+	if err := os.MkdirAll(lib, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.cbz", "b.cbz"} {
+		if err := os.WriteFile(filepath.Join(lib, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	groups := DupArchives{{
+		Head: &Archive{Name: filepath.Join(lib, "a.cbz"), Dev: 1, Inode: 1},
+		Dups: []*Archive{{Name: filepath.Join(lib, "b.cbz"), Dev: 1, Inode: 2}},
+	}}
+	err := rmDup(groups, nil, []string{lib}, filepath.Join(lib, "store"), quarantine, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !fileExist(filepath.Join(lib, "b.cbz")) {
+		t.Error("dry run moved duplicate")
+	}
+	if fileExist(quarantine) {
+		t.Error("dry run created quarantine")
+	}
+}
+
+func TestRmDupSkipsReviewedKeepAndNotDup(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib")
+	quarantine := filepath.Join(dir, "quarantine")
+	if err := os.MkdirAll(lib, 0755); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"a.cbz", "b.cbz", "c.cbz", "d.cbz", "e.cbz"}
+	archives := []*Archive{}
+	for i, name := range names {
+		if err := os.WriteFile(filepath.Join(lib, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		archives = append(archives, &Archive{Name: filepath.Join(lib, name), Dev: 1, Inode: int64(i + 1), Fingerprint: "fp"})
+	}
+
+	groups := DupArchives{{Head: archives[0], Dups: archives[1:]}}
+	review := &Review{Decisions: map[string]*ReviewDecision{}}
+	for i, decision := range []string{ReviewKeep, ReviewNotDup, ReviewDelete} {
+		archive := archives[i+1]
+		review.Decisions[reviewKey(archive)] = &ReviewDecision{Name: archive.Name, Fingerprint: archive.Fingerprint, Decision: decision}
+	}
+	err := rmDup(groups, review, []string{lib}, filepath.Join(lib, "store"), quarantine, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, moved := range []bool{false, false, false, true, true} {
+		if fileExist(archives[i].Name) == moved {
+			t.Errorf("%s moved %t, want %t", names[i], !moved, moved)
+		}
+	}
+}
+
+func TestReviewDecisionSurvivesCopy(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.cbz")
+	if err := os.WriteFile(file, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive := &Archive{Name: file, Dev: 1, Inode: 1, Fingerprint: "fp-a"}
+	review := &Review{Decisions: map[string]*ReviewDecision{
+		reviewKey(archive): {Name: file, Fingerprint: "fp-a", Decision: ReviewKeep},
+	}}
+
+	// copied back in place, as restore across filesystems or from backup does, new inode
+	if err := copyPath(file, file+".tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		t.Fatal(err)
+	}
+	restored := &Archive{Name: file, Dev: 2, Inode: 9, Fingerprint: "fp-a"}
+	if reviewSkip(review, restored) != ReviewKeep {
+		t.Error("decision lost when archive copied in place")
+	}
+
+	// copy elsewhere while the decided archive still exists is another archive
+	other := &Archive{Name: filepath.Join(dir, "b.cbz"), Dev: 1, Inode: 2, Fingerprint: "fp-a"}
+	if reviewSkip(review, other) != "" {
+		t.Error("decision of existing archive applied to its copy")
+	}
+
+	// moved to another path, the decided path is gone
+	moved := filepath.Join(dir, "sub", "a.cbz")
+	if err := movePath(file, moved); err != nil {
+		t.Fatal(err)
+	}
+	if reviewSkip(review, &Archive{Name: moved, Dev: 2, Inode: 10, Fingerprint: "fp-a"}) != ReviewKeep {
+		t.Error("decision lost when archive moved")
+	}
+
+	// rehashed content at the decided path
+	if reviewSkip(review, &Archive{Name: file, Dev: 1, Inode: 11, Fingerprint: "fp-b"}) != ReviewKeep {
+		t.Error("decision lost when archive content changed")
+	}
+}
@@ -0,0 +1,91 @@
+package core
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// pngPage small png page of shade
+func pngPage(t *testing.T, shade uint8) []byte {
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = shade + uint8(i)
+	}
+	img.Set(0, 0, color.Gray{Y: 255 - shade})
+	b := &bytes.Buffer{}
+	if err := png.Encode(b, img); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// writeZip write zip archive of named files
+func writeZip(t *testing.T, file string, names []string, data [][]byte) {
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for i, name := range names {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListDirByQueueSkipsCorruptArchive(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib")
+	store := filepath.Join(dir, "store")
+	if err := os.MkdirAll(lib, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := [][]byte{pngPage(t, 10), pngPage(t, 90)}
+	for _, name := range []string{"a.cbz", "c.cbz"} {
+		writeZip(t, filepath.Join(lib, name), []string{"1.png", "2.png"}, pages)
+	}
+	// truncated archive between the good ones
+	b, err := os.ReadFile(filepath.Join(lib, "a.cbz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(lib, "b.cbz"), b[:len(b)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = ListDirByQueue(context.Background(), []string{lib}, &Queue{}, false, ScanOptions{StoreDir: store, InFlight: 1})
+	if err != nil {
+		t.Fatalf("scan stopped by corrupt archive: %v", err)
+	}
+
+	st, err := OpenStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	for _, name := range []string{"a.cbz", "c.cbz"} {
+		archive, err := st.GetArchive(filepath.Join(lib, name))
+		if err != nil || archive == nil || len(archive.Images) != 2 {
+			t.Errorf("%s not saved: %v", name, err)
+		}
+	}
+	if cp := st.checkpoint(); cp != nil {
+		t.Errorf("checkpoint left after finished scan: %+v", cp)
+	}
+}
@@ -0,0 +1,699 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ninja-software/terror"
+	bolt "go.etcd.io/bbolt"
+)
+
+// single file image sum store, replacing one text file per archive.
+// archives are keyed by content fingerprint, path and inode are attributes of their locations
+//
+// meta:      "version" -> storeVersion, "checkpoint" -> scanCheckpoint json
+// archives:  fingerprint -> storeArchive json
+// pages:     fingerprint + page nth -> storePage json
+// locations: archive path -> storeLocation json
+// held:      fingerprint + archive path -> nil, locations holding each fingerprint
+
+// storeFile store file name, inside store dir
+const storeFile = "kagami.db"
+
+// storeVersion store schema version written
+const storeVersion = 2
+
+var (
+	bucketMeta      = []byte("meta")
+	bucketArchives  = []byte("archives")
+	bucketPages     = []byte("pages")
+	bucketLocations = []byte("locations")
+	bucketHeld      = []byte("held")
+)
+
+// Store image sums of archives and their pages
+type Store struct {
+	db   *bolt.DB
+	file string
+}
+
+// storeArchive archive content record
+type storeArchive struct {
+	Hashes []string `json:"hashes"` // image hash algorithms of the pages
+	Pages  int      `json:"pages"`  // number of page records
+}
+
+// storeLocation archive file holding the content of a fingerprint
+type storeLocation struct {
+	Fingerprint string    `json:"fingerprint"`
+	Dev         uint64    `json:"dev"`      // archive device
+	Inode       int64     `json:"inode"`    // archive inode
+	Size        int64     `json:"size"`     // archive size, see fileState
+	MTime       time.Time `json:"mtime"`    // archive modified time, see fileState
+	ScanTime    time.Time `json:"scanTime"` // when archive was hashed or linked
+}
+
+// scanCheckpoint where an interrupted scan stopped, the next scan of the same dirs resumes from it
+type scanCheckpoint struct {
+	Dirs []string  `json:"dirs"` // scan dirs
+	Dir  int       `json:"dir"`  // index of scan dir walked
+	File string    `json:"file"` // first file of the walk not saved
+	Time time.Time `json:"time"` // when scan stopped
+}
+
+// storePage page record
+type storePage struct {
+	Name   string            `json:"name"`
+	CRC32  uint32            `json:"crc32"`
+	MD5    [16]byte          `json:"md5"`
+	Size   uint64            `json:"size"`
+	Width  int               `json:"width"`
+	Height int               `json:"height"`
+	Format string            `json:"format"`
+	Hashes map[string]uint64 `json:"hashes"`
+}
+
+// OpenStore open or create the store inside store dir
+func OpenStore(dir string) (*Store, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, terror.New(err, "")
+	}
+
+	file := filepath.Join(dir, storeFile)
+	db, err := bolt.Open(file, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, terror.New(fmt.Errorf("open store %s: %w", file, err), "")
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(bucketMeta)
+		if err != nil {
+			return err
+		}
+		version := storeVersion
+		if v := meta.Get([]byte("version")); v != nil {
+			version = int(binary.BigEndian.Uint32(v))
+		}
+		if version > storeVersion {
+			return fmt.Errorf("store version %d newer than supported %d", version, storeVersion)
+		}
+
+		v := make([]byte, 4)
+		binary.BigEndian.PutUint32(v, storeVersion)
+		err = meta.Put([]byte("version"), v)
+		if err != nil {
+			return err
+		}
+		for _, name := range [][]byte{bucketArchives, bucketPages, bucketLocations, bucketHeld} {
+			_, err = tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, terror.New(err, "")
+	}
+
+	return &Store{db: db, file: file}, nil
+}
+
+// Close store
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// checkpoint where the last scan stopped, nil if it finished
+func (s *Store) checkpoint() *scanCheckpoint {
+	var cp *scanCheckpoint
+	s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMeta).Get([]byte("checkpoint"))
+		if b == nil {
+			return nil
+		}
+		c := &scanCheckpoint{}
+		if json.Unmarshal(b, c) == nil {
+			cp = c
+		}
+		return nil
+	})
+	return cp
+}
+
+// setCheckpoint save where the scan stopped, nil clears it
+func (s *Store) setCheckpoint(cp *scanCheckpoint) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(bucketMeta)
+		if cp == nil {
+			return meta.Delete([]byte("checkpoint"))
+		}
+		b, err := json.Marshal(cp)
+		if err != nil {
+			return err
+		}
+		return meta.Put([]byte("checkpoint"), b)
+	})
+}
+
+// archiveKey store key of archive fingerprint
+func archiveKey(fp string) []byte {
+	key, err := hex.DecodeString(fp)
+	if err != nil {
+		return []byte(fp)
+	}
+	return key
+}
+
+// pageRecordKey store key of nth page of archive
+func pageRecordKey(key []byte, nth int) []byte {
+	pk := make([]byte, len(key)+4)
+	copy(pk, key)
+	binary.BigEndian.PutUint32(pk[len(key):], uint32(nth))
+	return pk
+}
+
+// putRecord save archive content record and its pages, replacing the previous record
+func putRecord(tx *bolt.Tx, key []byte, archive *Archive) error {
+	err := deleteRecord(tx, key)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(&storeArchive{
+		Hashes: archive.Hashes,
+		Pages:  len(archive.Images),
+	})
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(bucketArchives).Put(key, b)
+	if err != nil {
+		return err
+	}
+
+	pages := tx.Bucket(bucketPages)
+	for nth, image := range archive.Images {
+		b, err := json.Marshal(&storePage{
+			Name:   image.Name,
+			CRC32:  image.CRC32,
+			MD5:    image.MD5,
+			Size:   image.DataSize,
+			Width:  image.Width,
+			Height: image.Height,
+			Format: image.Format,
+			Hashes: image.Hashes,
+		})
+		if err != nil {
+			return err
+		}
+		err = pages.Put(pageRecordKey(key, nth), b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteRecord delete archive content record and its pages
+func deleteRecord(tx *bolt.Tx, key []byte) error {
+	err := tx.Bucket(bucketArchives).Delete(key)
+	if err != nil {
+		return err
+	}
+
+	c := tx.Bucket(bucketPages).Cursor()
+	for k, _ := c.Seek(key); k != nil && len(k) == len(key)+4 && bytes.HasPrefix(k, key); k, _ = c.Seek(key) {
+		err = c.Delete()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getLocation location of archive path, nil if not in store
+func getLocation(tx *bolt.Tx, name string) *storeLocation {
+	b := tx.Bucket(bucketLocations).Get([]byte(name))
+	if b == nil {
+		return nil
+	}
+	loc := &storeLocation{}
+	if json.Unmarshal(b, loc) != nil {
+		return nil
+	}
+	return loc
+}
+
+// heldBy archive paths holding fingerprint
+func heldBy(tx *bolt.Tx, fp string) []string {
+	key := archiveKey(fp)
+	names := []string{}
+	c := tx.Bucket(bucketHeld).Cursor()
+	for k, _ := c.Seek(key); k != nil && bytes.HasPrefix(k, key); k, _ = c.Next() {
+		names = append(names, string(k[len(key):]))
+	}
+	return names
+}
+
+// putLocation point archive path to fingerprint, dropping the record the path held before if no longer used
+func putLocation(tx *bolt.Tx, name string, loc *storeLocation) error {
+	old := getLocation(tx, name)
+
+	b, err := json.Marshal(loc)
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(bucketLocations).Put([]byte(name), b)
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(bucketHeld).Put(append(archiveKey(loc.Fingerprint), name...), []byte{})
+	if err != nil {
+		return err
+	}
+
+	if old != nil && old.Fingerprint != loc.Fingerprint {
+		err = tx.Bucket(bucketHeld).Delete(append(archiveKey(old.Fingerprint), name...))
+		if err != nil {
+			return err
+		}
+		return dropUnused(tx, old.Fingerprint)
+	}
+	return nil
+}
+
+// deleteLocation delete archive path, dropping its record if no longer used
+func deleteLocation(tx *bolt.Tx, name string) error {
+	loc := getLocation(tx, name)
+	if loc == nil {
+		return nil
+	}
+	err := tx.Bucket(bucketLocations).Delete([]byte(name))
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(bucketHeld).Delete(append(archiveKey(loc.Fingerprint), name...))
+	if err != nil {
+		return err
+	}
+	return dropUnused(tx, loc.Fingerprint)
+}
+
+// dropUnused delete archive content record of fingerprint if no location holds it
+func dropUnused(tx *bolt.Tx, fp string) error {
+	if len(heldBy(tx, fp)) > 0 {
+		return nil
+	}
+	return deleteRecord(tx, archiveKey(fp))
+}
+
+// PutArchive save archive pages under its fingerprint and archive path as a location of it
+func (s *Store) PutArchive(archive *Archive) error {
+	return s.putArchive(archive, time.Now())
+}
+
+// putArchive save archive hashed at scanTime
+func (s *Store) putArchive(archive *Archive, scanTime time.Time) error {
+	if archive.Fingerprint == "" {
+		archive.Fingerprint = imagesFingerprint(archive.Images)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := putRecord(tx, archiveKey(archive.Fingerprint), archive)
+		if err != nil {
+			return err
+		}
+		return putLocation(tx, archive.Name, &storeLocation{
+			Fingerprint: archive.Fingerprint,
+			Dev:         archive.Dev,
+			Inode:       archive.Inode,
+			Size:        archive.Size,
+			MTime:       archive.MTime,
+			ScanTime:    scanTime,
+		})
+	})
+}
+
+// Known check if archive content of fingerprint is stored with every hash in algos
+func (s *Store) Known(fp string, algos []string) bool {
+	known := false
+	s.db.View(func(tx *bolt.Tx) error {
+		known = hashedWith(tx, fp, algos)
+		return nil
+	})
+	return known
+}
+
+// hashedWith check if archive content of fingerprint is stored with every hash in algos
+func hashedWith(tx *bolt.Tx, fp string, algos []string) bool {
+	b := tx.Bucket(bucketArchives).Get(archiveKey(fp))
+	if b == nil {
+		return false
+	}
+	rec := &storeArchive{}
+	if json.Unmarshal(b, rec) != nil {
+		return false
+	}
+	archive := &Archive{Hashes: rec.Hashes}
+	for _, algo := range algos {
+		if !archive.hasHash(algo) {
+			return false
+		}
+	}
+	return true
+}
+
+// Link add archive path as a location of stored content, without hashing its pages.
+// other locations of the content whose file is gone are dropped, so a move replaces the old path
+func (s *Store) Link(fp, name string, id fileID, size int64, mtime time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketArchives).Get(archiveKey(fp)) == nil {
+			return fmt.Errorf("no record of %s", fp)
+		}
+
+		for _, old := range heldBy(tx, fp) {
+			if old == name || fileExist(old) {
+				continue
+			}
+			fmt.Fprintf(scanOut, "moved %s -> %s\n", old, name)
+			err := deleteLocation(tx, old)
+			if err != nil {
+				return err
+			}
+		}
+
+		return putLocation(tx, name, &storeLocation{
+			Fingerprint: fp,
+			Dev:         id.Dev,
+			Inode:       int64(id.Ino),
+			Size:        size,
+			MTime:       mtime,
+			ScanTime:    time.Now(),
+		})
+	})
+}
+
+// DeleteArchive delete archive path, and its content record if no other location holds it
+func (s *Store) DeleteArchive(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return deleteLocation(tx, name)
+	})
+}
+
+// Unchanged check if archive at path is stored with the same file identity, size and modified time,
+// and with every hash in algos.
+// records stored before size was kept never match, their fingerprint is checked instead
+func (s *Store) Unchanged(name string, id fileID, size int64, mtime time.Time, algos []string) bool {
+	unchanged := false
+	s.db.View(func(tx *bolt.Tx) error {
+		loc := getLocation(tx, name)
+		unchanged = loc != nil && loc.Dev == id.Dev && loc.Inode == int64(id.Ino) &&
+			loc.Size == size && loc.Size > 0 && loc.MTime.Equal(mtime) &&
+			hashedWith(tx, loc.Fingerprint, algos)
+		return nil
+	})
+	return unchanged
+}
+
+// locations every archive path in store with its location, unreadable locations are reported to w and skipped
+func (s *Store) locations(w io.Writer) (map[string]*storeLocation, error) {
+	locs := map[string]*storeLocation{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketLocations).ForEach(func(k, v []byte) error {
+			loc := &storeLocation{}
+			err := json.Unmarshal(v, loc)
+			if err != nil {
+				fmt.Fprintln(w, "err store location", string(k), err)
+				return nil
+			}
+			locs[string(k)] = loc
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, terror.New(err, "")
+	}
+	return locs, nil
+}
+
+// relink move location of archive path to the path the archive file is now at
+func (s *Store) relink(from, to string, id fileID, size int64, mtime time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		loc := getLocation(tx, from)
+		if loc == nil {
+			return fmt.Errorf("no location of %s", from)
+		}
+		err := putLocation(tx, to, &storeLocation{
+			Fingerprint: loc.Fingerprint,
+			Dev:         id.Dev,
+			Inode:       int64(id.Ino),
+			Size:        size,
+			MTime:       mtime,
+			ScanTime:    loc.ScanTime,
+		})
+		if err != nil {
+			return err
+		}
+		return deleteLocation(tx, from)
+	})
+}
+
+// orphans fingerprints of content records no location holds once the gone archive paths are deleted
+func (s *Store) orphans(gone map[string]bool) ([]string, error) {
+	fps := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketArchives).ForEach(func(k, v []byte) error {
+			fp := hex.EncodeToString(k)
+			for _, name := range heldBy(tx, fp) {
+				if !gone[name] {
+					return nil
+				}
+			}
+			fps = append(fps, fp)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, terror.New(err, "")
+	}
+	return fps, nil
+}
+
+// dropOrphan delete content record of fingerprint if no location holds it
+func (s *Store) dropOrphan(fp string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return dropUnused(tx, fp)
+	})
+}
+
+// loadImages pages of archive content record
+func loadImages(tx *bolt.Tx, key []byte) ([]*ZipImage, []string, error) {
+	b := tx.Bucket(bucketArchives).Get(key)
+	if b == nil {
+		return nil, nil, fmt.Errorf("no record of %x", key)
+	}
+	rec := &storeArchive{}
+	err := json.Unmarshal(b, rec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	images := []*ZipImage{}
+	c := tx.Bucket(bucketPages).Cursor()
+	for k, v := c.Seek(key); k != nil && len(k) == len(key)+4 && bytes.HasPrefix(k, key); k, v = c.Next() {
+		nth := len(images)
+		if int(binary.BigEndian.Uint32(k[len(key):])) != nth {
+			return nil, nil, fmt.Errorf("missing page %d of %x", nth, key)
+		}
+		page := &storePage{}
+		err = json.Unmarshal(v, page)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid page %d of %x: %w", nth, key, err)
+		}
+		images = append(images, &ZipImage{
+			Nth:       nth,
+			CRC32:     page.CRC32,
+			MD5:       page.MD5,
+			Name:      page.Name,
+			DataSize:  page.Size,
+			Parsed:    true,
+			HashAlgos: rec.Hashes,
+			Hashes:    page.Hashes,
+			Format:    page.Format,
+			Width:     page.Width,
+			Height:    page.Height,
+		})
+	}
+	if len(images) != rec.Pages {
+		return nil, nil, fmt.Errorf("missing pages of %x, %d of %d", key, len(images), rec.Pages)
+	}
+
+	return images, rec.Hashes, nil
+}
+
+// locationArchive archive at location, sharing pages of the content record
+func locationArchive(name string, loc *storeLocation, images []*ZipImage, hashes []string) *Archive {
+	return &Archive{
+		Name:        name,
+		MTime:       loc.MTime,
+		Dev:         loc.Dev,
+		Inode:       loc.Inode,
+		Size:        loc.Size,
+		Fingerprint: loc.Fingerprint,
+		Hashes:      hashes,
+		Images:      images,
+	}
+}
+
+// GetArchive archive at path, nil if not in store
+func (s *Store) GetArchive(name string) (*Archive, error) {
+	var archive *Archive
+	err := s.db.View(func(tx *bolt.Tx) error {
+		loc := getLocation(tx, name)
+		if loc == nil {
+			return nil
+		}
+		images, hashes, err := loadImages(tx, archiveKey(loc.Fingerprint))
+		if err != nil {
+			return err
+		}
+		archive = locationArchive(name, loc, images, hashes)
+		return nil
+	})
+	if err != nil {
+		return nil, terror.New(err, "")
+	}
+	return archive, nil
+}
+
+// Archives every archive location in store, copies share the pages of their content.
+// invalid records are reported to w and skipped
+func (s *Store) Archives(w io.Writer) (Archives, error) {
+	archives := Archives{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		type content struct {
+			images []*ZipImage
+			hashes []string
+			err    error
+		}
+		contents := map[string]*content{}
+
+		return tx.Bucket(bucketLocations).ForEach(func(k, v []byte) error {
+			loc := &storeLocation{}
+			err := json.Unmarshal(v, loc)
+			if err != nil {
+				fmt.Fprintln(w, "err store location", string(k), err)
+				return nil
+			}
+
+			c := contents[loc.Fingerprint]
+			if c == nil {
+				c = &content{}
+				c.images, c.hashes, c.err = loadImages(tx, archiveKey(loc.Fingerprint))
+				contents[loc.Fingerprint] = c
+			}
+			if c.err != nil {
+				fmt.Fprintln(w, "err store record", string(k), c.err)
+				return nil
+			}
+
+			archives = append(archives, locationArchive(string(k), loc, c.images, c.hashes))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, terror.New(err, "")
+	}
+	return archives, nil
+}
+
+// loadStore load every archive from store inside store dir, invalid records are reported to w
+func loadStore(dir string, w io.Writer) (Archives, error) {
+	if !fileExist(filepath.Join(dir, storeFile)) {
+		matches, _ := filepath.Glob(filepath.Join(dir, "*.txt"))
+		if len(matches) > 0 {
+			return nil, fmt.Errorf("no %s in %s, import the text records with -mode migrate", storeFile, dir)
+		}
+	}
+
+	st, err := OpenStore(dir)
+	if err != nil {
+		return nil, terror.New(err, "")
+	}
+	defer st.Close()
+
+	return st.Archives(w)
+}
+
+// moveStoreRecord move archive at path from store dir to another store dir under a new path
+func moveStoreRecord(fromDir, fromName, toDir, toName string) error {
+	from, err := OpenStore(fromDir)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	archive, err := from.GetArchive(fromName)
+	if err != nil {
+		return err
+	}
+	if archive == nil {
+		return os.ErrNotExist
+	}
+	archive.Name = toName
+
+	to, err := OpenStore(toDir)
+	if err != nil {
+		return err
+	}
+	defer to.Close()
+
+	err = to.PutArchive(archive)
+	if err != nil {
+		return err
+	}
+	return from.DeleteArchive(fromName)
+}
+
+// MigrateStore import text image sum records inside store dir into the store.
+// records with invalid lines are reported and left out, text files are kept
+func MigrateStore(dir string) error {
+	archives, err := loadSums(dir)
+	if err != nil {
+		return terror.New(err, "")
+	}
+
+	st, err := OpenStore(dir)
+	if err != nil {
+		return terror.New(err, "")
+	}
+	defer st.Close()
+
+	for _, archive := range archives {
+		// keep when the record was written, so recent records are not rescanned
+		scanTime := time.Now()
+		info, err := os.Stat(filepath.Join(dir, fmt.Sprintf("%d.txt", archive.Inode)))
+		if err == nil {
+			scanTime = info.ModTime()
+		}
+
+		err = st.putArchive(archive, scanTime)
+		if err != nil {
+			return terror.New(err, "")
+		}
+		fmt.Printf("imported (%d) %s, %d pages\n", archive.Inode, archive.Name, len(archive.Images))
+	}
+
+	fmt.Printf("imported %d archives into %s\n", len(archives), st.file)
+	return nil
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestStoreArchivesReportsBadRecordsToWriter(t *testing.T) {
+	st, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	archive := testArchive(1, []uint64{1, 2, 3})
+	if err := st.PutArchive(archive); err != nil {
+		t.Fatal(err)
+	}
+	err = st.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketLocations).Put([]byte("/lib/bad.cbz"), []byte("{"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	archives, err := st.Archives(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archives) != 1 || archives[0].Name != archive.Name {
+		t.Errorf("expected only %s, got %d archives", archive.Name, len(archives))
+	}
+	if !strings.Contains(out.String(), "err store location /lib/bad.cbz") {
+		t.Errorf("bad location not reported, got %q", out.String())
+	}
+}
+
+func TestUnchangedRequiresStoredHashes(t *testing.T) {
+	st, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	archive := testArchive(7, []uint64{1, 2, 3})
+	archive.Size = 100
+	archive.MTime = time.Unix(1700000000, 0)
+	if err := st.PutArchive(archive); err != nil {
+		t.Fatal(err)
+	}
+	id := archive.id()
+
+	if !st.Unchanged(archive.Name, id, archive.Size, archive.MTime, []string{HashAverage}) {
+		t.Error("archive stored with ahash not unchanged for ahash")
+	}
+	if st.Unchanged(archive.Name, id, archive.Size, archive.MTime, []string{HashAverage, HashDifference}) {
+		t.Error("archive stored without dhash unchanged for dhash")
+	}
+	if !scanNeeded(st, archive.Name, id, archive.Size, archive.MTime, ScanOptions{HashAlgos: []string{HashDifference}}) {
+		t.Error("archive stored without dhash not rescanned for dhash")
+	}
+}
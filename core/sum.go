@@ -0,0 +1,96 @@
+package core
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// image sum text record, one file per archive, imported by migrate.
+// lines are still printed while scanning
+//
+// v1: crc32 md5 size width height phash name
+// v2: crc32 md5 size width height format phash name
+// v3: v2 with "# hash:" header naming the phash algorithm, ahash before v3
+// v4: crc32 md5 size width height format hash... name, one hash per algorithm in "# hash:" header
+
+// sumLine image sum record line of image, hashes in algos order
+func sumLine(zz *ZipImage, algos []string) string {
+	line := fmt.Sprintf("%08X %032X %9d %04d %04d %-4s", zz.CRC32, zz.MD5, zz.DataSize, zz.Width, zz.Height, zz.Format)
+	for _, algo := range algos {
+		line += fmt.Sprintf(" %016X", zz.Hashes[algo])
+	}
+	return line + " " + zz.Name
+}
+
+// cutField cut the first space separated field off s
+func cutField(s string) (string, string) {
+	s = strings.TrimLeft(s, " ")
+	i := strings.IndexByte(s, ' ')
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i+1:]
+}
+
+// parseSumLine parse image sum record line of given version, hashes in algos order
+func parseSumLine(line string, version int, algos []string) (*ZipImage, error) {
+	zz := &ZipImage{
+		Hashes: map[string]uint64{},
+	}
+
+	var f string
+	rest := line
+
+	f, rest = cutField(rest)
+	crc, err := strconv.ParseUint(f, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid crc32 %q", f)
+	}
+	zz.CRC32 = uint32(crc)
+
+	f, rest = cutField(rest)
+	b, err := hex.DecodeString(f)
+	if err != nil || len(b) != len(zz.MD5) {
+		return nil, fmt.Errorf("invalid md5 %q", f)
+	}
+	copy(zz.MD5[:], b)
+
+	f, rest = cutField(rest)
+	zz.DataSize, err = strconv.ParseUint(f, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid size %q", f)
+	}
+
+	f, rest = cutField(rest)
+	zz.Width, err = strconv.Atoi(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid width %q", f)
+	}
+
+	f, rest = cutField(rest)
+	zz.Height, err = strconv.Atoi(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid height %q", f)
+	}
+
+	if version >= 2 {
+		zz.Format, rest = cutField(rest)
+	}
+
+	for _, algo := range algos {
+		f, rest = cutField(rest)
+		zz.Hashes[algo], err = strconv.ParseUint(f, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", algo, f)
+		}
+	}
+
+	if rest == "" {
+		return nil, fmt.Errorf("missing name")
+	}
+	zz.Name = rest
+
+	return zz, nil
+}
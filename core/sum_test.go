@@ -0,0 +1,135 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSumLineVersions(t *testing.T) {
+	md5 := [16]byte{0x0f, 0x1e, 0x2d, 0x3c, 0x4b, 0x5a, 0x69, 0x78, 0x87, 0x96, 0xa5, 0xb4, 0xc3, 0xd2, 0xe1, 0xf0}
+
+	tests := []struct {
+		name    string
+		line    string
+		version int
+		algos   []string
+		want    *ZipImage
+	}{
+		{
+			name:    "v1",
+			line:    "0A1B2C3D 0F1E2D3C4B5A69788796A5B4C3D2E1F0     12345 0800 1200 00000000FFFFFFFF 001.jpg",
+			version: 1,
+			algos:   []string{HashAverage},
+			want: &ZipImage{CRC32: 0x0a1b2c3d, MD5: md5, DataSize: 12345, Width: 800, Height: 1200,
+				Hashes: map[string]uint64{HashAverage: 0xffffffff}, Name: "001.jpg"},
+		},
+		{
+			name:    "v2",
+			line:    "0A1B2C3D 0F1E2D3C4B5A69788796A5B4C3D2E1F0     12345 0800 1200 png  00000000FFFFFFFF dir/page 1.png",
+			version: 2,
+			algos:   []string{HashAverage},
+			want: &ZipImage{CRC32: 0x0a1b2c3d, MD5: md5, DataSize: 12345, Width: 800, Height: 1200, Format: "png",
+				Hashes: map[string]uint64{HashAverage: 0xffffffff}, Name: "dir/page 1.png"},
+		},
+		{
+			name:    "v3",
+			line:    "0A1B2C3D 0F1E2D3C4B5A69788796A5B4C3D2E1F0     12345 0800 1200 jpeg 8000000000000001 001.jpg",
+			version: 3,
+			algos:   []string{HashDifference},
+			want: &ZipImage{CRC32: 0x0a1b2c3d, MD5: md5, DataSize: 12345, Width: 800, Height: 1200, Format: "jpeg",
+				Hashes: map[string]uint64{HashDifference: 0x8000000000000001}, Name: "001.jpg"},
+		},
+		{
+			name:    "v4",
+			line:    "0A1B2C3D 0F1E2D3C4B5A69788796A5B4C3D2E1F0     12345 0800 1200 gif  0000000000000001 0000000000000002 001.gif",
+			version: 4,
+			algos:   []string{HashAverage, HashDifference},
+			want: &ZipImage{CRC32: 0x0a1b2c3d, MD5: md5, DataSize: 12345, Width: 800, Height: 1200, Format: "gif",
+				Hashes: map[string]uint64{HashAverage: 1, HashDifference: 2}, Name: "001.gif"},
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSumLine(tt.line, tt.version, tt.algos)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+
+		// written lines read back the same
+		if tt.version == 4 {
+			again, err := parseSumLine(sumLine(got, tt.algos), tt.version, tt.algos)
+			if err != nil || !reflect.DeepEqual(again, got) {
+				t.Errorf("%s: sumLine round trip got %+v, %v", tt.name, again, err)
+			}
+		}
+	}
+}
+
+func TestParseSumLineMalformed(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"XYZ 0F1E2D3C4B5A69788796A5B4C3D2E1F0 12345 0800 1200 png 0000000000000001 a.png", "invalid crc32"},
+		{"0A1B2C3D 0F1E 12345 0800 1200 png 0000000000000001 a.png", "invalid md5"},
+		{"0A1B2C3D 0F1E2D3C4B5A69788796A5B4C3D2E1F0 big 0800 1200 png 0000000000000001 a.png", "invalid size"},
+		{"0A1B2C3D 0F1E2D3C4B5A69788796A5B4C3D2E1F0 12345 wide 1200 png 0000000000000001 a.png", "invalid width"},
+		{"0A1B2C3D 0F1E2D3C4B5A69788796A5B4C3D2E1F0 12345 0800 tall png 0000000000000001 a.png", "invalid height"},
+		{"0A1B2C3D 0F1E2D3C4B5A69788796A5B4C3D2E1F0 12345 0800 1200 png nothex a.png", "invalid ahash"},
+		{"0A1B2C3D 0F1E2D3C4B5A69788796A5B4C3D2E1F0 12345 0800 1200 png 0000000000000001", "missing name"},
+	}
+
+	for _, tt := range tests {
+		_, err := parseSumLine(tt.line, 4, []string{HashAverage})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got error %v, want %s", tt.line, err, tt.want)
+		}
+	}
+}
+
+func TestLoadSumReportsMalformedLine(t *testing.T) {
+	dir := t.TempDir()
+
+	good := filepath.Join(dir, "42.txt")
+	err := os.WriteFile(good, []byte(`# kagami_imgsum_ver: 4
+# file: /lib/a.cbz
+# hash: ahash dhash
+0A1B2C3D 0F1E2D3C4B5A69788796A5B4C3D2E1F0     12345 0800 1200 png  0000000000000001 0000000000000002 001.png
+0A1B2C3D 0F1E2D3C4B5A69788796A5B4C3D2E1F0     12345 0800 1200 png  0000000000000003 0000000000000004 002.png
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := loadSum(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archive.Inode != 42 || archive.Name != "/lib/a.cbz" || len(archive.Images) != 2 {
+		t.Fatalf("got inode %d name %s pages %d", archive.Inode, archive.Name, len(archive.Images))
+	}
+	if !reflect.DeepEqual(archive.Hashes, []string{HashAverage, HashDifference}) || archive.Images[1].Nth != 1 ||
+		archive.Images[1].Hashes[HashDifference] != 4 {
+		t.Errorf("got hashes %v, second page %+v", archive.Hashes, archive.Images[1])
+	}
+
+	bad := filepath.Join(dir, "43.txt")
+	err = os.WriteFile(bad, []byte(`# kagami_imgsum_ver: 2
+# file: /lib/b.cbz
+0A1B2C3D 0F1E2D3C4B5A69788796A5B4C3D2E1F0     12345 0800 1200 png  0000000000000001 001.png
+0A1B2C3D 0F1E2D3C4B5A69788796A5B4C3D2E1F0     12345 0800 1200 png
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadSum(bad)
+	if err == nil || !strings.Contains(err.Error(), "line 4") {
+		t.Errorf("expected error on line 4, got %v", err)
+	}
+}
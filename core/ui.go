@@ -0,0 +1,481 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ninja-software/terror"
+	"golang.org/x/image/draw"
+)
+
+// web interface for reviewing duplicate groups
+
+// UIPort web interface port
+const UIPort = "4123"
+
+// reviewFile saved review decisions, inside store dir
+const reviewFile = "kagami_review.json"
+
+// review decisions
+const (
+	ReviewKeep   = "keep"
+	ReviewDelete = "delete"
+	ReviewNotDup = "notdup"
+)
+
+// thumbWidth cover thumbnail width
+const thumbWidth = 200
+
+// errStopWalk stops archive walk early
+var errStopWalk = errors.New("stop walk")
+
+// ReviewDecision reviewer choice for an archive in a duplicate group
+type ReviewDecision struct {
+	Name        string    `json:"name"`        // archive path when decided
+	Fingerprint string    `json:"fingerprint"` // archive content fingerprint
+	Group       string    `json:"group"`       // group key, sorted member fingerprints
+	Decision    string    `json:"decision"`    // keep, delete or notdup
+	Time        time.Time `json:"time"`
+}
+
+// Review saved review decisions by archive fingerprint and path, see reviewKey.
+// device and inode are not used, they change when an archive is copied back from quarantine or backup
+type Review struct {
+	Decisions map[string]*ReviewDecision `json:"decisions"`
+}
+
+// uiServer serves duplicate groups for review
+type uiServer struct {
+	groups   DupArchives
+	archives map[string]*Archive // by device:inode
+	file     string              // review file
+	mux      sync.Mutex
+	review   *Review
+}
+
+// HostUI serve web interface on listen address for reviewing duplicate groups in store dir
+func HostUI(storeDir, listenIP string, opts CheckOptions) error {
+	if listenIP == "" {
+		listenIP = "localhost"
+	}
+
+	groups, err := loadDups(storeDir, opts)
+	if err != nil {
+		return terror.New(err, "")
+	}
+
+	s := &uiServer{
+		groups:   groups,
+		archives: map[string]*Archive{},
+		file:     filepath.Join(storeDir, reviewFile),
+	}
+	for _, dup := range groups {
+		s.archives[dup.Head.id().String()] = dup.Head
+		for _, d := range dup.Dups {
+			s.archives[d.id().String()] = d
+		}
+	}
+	s.review, err = loadReview(s.file)
+	if err != nil {
+		return terror.New(err, "")
+	}
+
+	http.HandleFunc("/", s.handleIndex)
+	http.HandleFunc("/cover", s.handleCover)
+	http.HandleFunc("/decide", s.handleDecide)
+	http.HandleFunc("/compare", s.handleCompare)
+	http.HandleFunc("/page", s.handlePage)
+
+	listen := listenIP + ":" + UIPort
+	fmt.Printf("found %d dup groups, serving http://%s\n", len(groups), listen)
+
+	return http.ListenAndServe(listen, nil)
+}
+
+func loadReview(file string) (*Review, error) {
+	review := &Review{
+		Decisions: map[string]*ReviewDecision{},
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return review, nil
+	}
+	if err != nil {
+		return nil, terror.New(err, "")
+	}
+
+	err = json.Unmarshal(b, review)
+	if err != nil {
+		return nil, terror.New(err, "")
+	}
+	if review.Decisions == nil {
+		review.Decisions = map[string]*ReviewDecision{}
+	}
+
+	return review, nil
+}
+
+// saveReview write review file, replacing the old one
+func saveReview(file string, review *Review) error {
+	b, err := json.MarshalIndent(review, "", "  ")
+	if err != nil {
+		return terror.New(err, "")
+	}
+
+	tmp := file + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return terror.New(err, "")
+	}
+
+	return os.Rename(tmp, file)
+}
+
+// groupKey identify group by its sorted member fingerprints
+func groupKey(dup *DupArchive) string {
+	fps := []string{}
+	for _, archive := range append([]*Archive{dup.Head}, dup.Dups...) {
+		fps = append(fps, archive.Fingerprint)
+	}
+	sort.Strings(fps)
+	return strings.Join(fps, ",")
+}
+
+// reviewKey key of archive decision, copies of the same content are told apart by path
+func reviewKey(archive *Archive) string {
+	return archive.Fingerprint + " " + archive.Name
+}
+
+// decision saved decision of archive, nil if none.
+// a decision follows its content to another path once the decided path is gone,
+// otherwise stays with the path when its content changed. latest decision wins
+func (review *Review) decision(archive *Archive) *ReviewDecision {
+	if d := review.Decisions[reviewKey(archive)]; d != nil {
+		return d
+	}
+
+	var moved, byPath *ReviewDecision
+	later := func(a, b *ReviewDecision) bool {
+		return b == nil || a.Time.After(b.Time) || (a.Time.Equal(b.Time) && a.Name < b.Name)
+	}
+	for _, d := range review.Decisions {
+		if archive.Fingerprint != "" && d.Fingerprint == archive.Fingerprint && !fileExist(d.Name) && later(d, moved) {
+			moved = d
+		}
+		if d.Name == archive.Name && later(d, byPath) {
+			byPath = d
+		}
+	}
+	if moved != nil {
+		return moved
+	}
+	return byPath
+}
+
+// decision saved decision of archive in group, nil if none
+func (s *uiServer) decision(archive *Archive, dup *DupArchive) *ReviewDecision {
+	if d := s.review.decision(archive); d != nil && d.Group == groupKey(dup) {
+		return d
+	}
+	return nil
+}
+
+// uiArchive archive detail for template
+type uiArchive struct {
+	ID       string // device:inode
+	Inode    int64
+	Name     string
+	FileSize int64
+	Pages    int
+	Bytes    uint64
+	Median   string
+	Head     bool
+	HeadID   string // device:inode of group head, to compare with
+	Decision string
+}
+
+// uiGroup group detail for template
+type uiGroup struct {
+	N        int
+	Key      string
+	Archives []*uiArchive
+}
+
+func (s *uiServer) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mux.Lock()
+	groups := []*uiGroup{}
+	for n, dup := range s.groups {
+		g := &uiGroup{
+			N:   n + 1,
+			Key: groupKey(dup),
+		}
+		for _, archive := range append([]*Archive{dup.Head}, dup.Dups...) {
+			ua := &uiArchive{
+				ID:     archive.id().String(),
+				Inode:  archive.Inode,
+				Name:   archive.Name,
+				Pages:  len(archive.Images),
+				Bytes:  uint64(keepBytes(archive)),
+				Head:   archive == dup.Head,
+				HeadID: dup.Head.id().String(),
+			}
+			if info, err := os.Stat(archive.Name); err == nil {
+				ua.FileSize = info.Size()
+			}
+			if image := medianImage(archive); image != nil {
+				ua.Median = fmt.Sprintf("%dx%d", image.Width, image.Height)
+			}
+			if d := s.decision(archive, dup); d != nil {
+				ua.Decision = d.Decision
+			}
+			g.Archives = append(g.Archives, ua)
+		}
+		groups = append(groups, g)
+	}
+	s.mux.Unlock()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := uiTemplate.Execute(w, groups)
+	if err != nil {
+		fmt.Println("err ui template", err)
+	}
+}
+
+func (s *uiServer) handleCover(w http.ResponseWriter, r *http.Request) {
+	archive := s.archives[r.URL.Query().Get("id")]
+	if archive == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	img, err := archivePage(archive.Name, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	jpeg.Encode(w, img, &jpeg.Options{Quality: 80})
+}
+
+func (s *uiServer) handleDecide(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	group := r.PostForm.Get("group")
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for id, archive := range s.archives {
+		decision := r.PostForm.Get("d" + id)
+		if decision == "" {
+			continue
+		}
+		if decision != ReviewKeep && decision != ReviewDelete && decision != ReviewNotDup {
+			http.Error(w, "invalid decision", http.StatusBadRequest)
+			return
+		}
+		s.review.Decisions[reviewKey(archive)] = &ReviewDecision{
+			Name:        archive.Name,
+			Fingerprint: archive.Fingerprint,
+			Group:       group,
+			Decision:    decision,
+			Time:        time.Now(),
+		}
+	}
+
+	err = saveReview(s.file, s.review)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/#g"+r.PostForm.Get("n"), http.StatusSeeOther)
+}
+
+func (s *uiServer) handleCompare(w http.ResponseWriter, r *http.Request) {
+	var archives [2]*Archive
+	for i, key := range []string{"a", "b"} {
+		archives[i] = s.archives[r.URL.Query().Get(key)]
+		if archives[i] == nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	cmp := compareArchives(archives[0], archives[1])
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := uiCompareTemplate.Execute(w, cmp)
+	if err != nil {
+		fmt.Println("err ui template", err)
+	}
+}
+
+func (s *uiServer) handlePage(w http.ResponseWriter, r *http.Request) {
+	archive := s.archives[r.URL.Query().Get("id")]
+	if archive == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	img, err := archivePage(archive.Name, r.URL.Query().Get("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	jpeg.Encode(w, img, &jpeg.Options{Quality: 80})
+}
+
+// archivePage image named name in archive scaled to thumbnail, first image if name is empty
+func archivePage(file, name string) (image.Image, error) {
+	var img image.Image
+	err := readArchive(file, func(e *ArchiveEntry) error {
+		if name != "" && e.Name != name {
+			return nil
+		}
+		var err error
+		img, _, err = image.Decode(bytes.NewReader(e.Data))
+		if err != nil {
+			return err
+		}
+		return errStopWalk
+	})
+	if err != nil && !errors.Is(err, errStopWalk) {
+		return nil, terror.New(err, "")
+	}
+	if img == nil {
+		return nil, fmt.Errorf("no image")
+	}
+
+	return thumbnail(img, thumbWidth), nil
+}
+
+// thumbnail scale image to width, keeping aspect ratio
+func thumbnail(img image.Image, width int) image.Image {
+	b := img.Bounds()
+	if b.Dx() == 0 {
+		return img
+	}
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst
+}
+
+var uiTemplate = template.Must(template.New("ui").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Kagami - duplicate groups</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+.group { border: 1px solid #ccc; margin: 1em 0; padding: .5em; }
+.archives { display: flex; flex-wrap: wrap; gap: 1em; }
+.archive { width: 220px; font-size: 12px; word-break: break-all; }
+.archive.head { background: #eef7ee; }
+.archive img { width: 200px; display: block; background: #eee; }
+.decision-keep { outline: 3px solid #4a4; }
+.decision-delete { outline: 3px solid #c44; }
+.decision-notdup { outline: 3px solid #888; }
+</style>
+</head>
+<body>
+<h1>{{len .}} duplicate groups</h1>
+{{range .}}
+<form class="group" id="g{{.N}}" method="post" action="/decide">
+<input type="hidden" name="group" value="{{.Key}}">
+<input type="hidden" name="n" value="{{.N}}">
+<h2>#{{.N}}</h2>
+<div class="archives">
+{{range .Archives}}
+<div class="archive{{if .Head}} head{{end}}{{if .Decision}} decision-{{.Decision}}{{end}}">
+<img loading="lazy" src="/cover?id={{.ID}}" alt="cover">
+<div>{{.Name}}</div>
+<div>device:inode {{.ID}}{{if .Head}}, policy keep{{end}}</div>
+<div>{{.FileSize}} bytes on disk</div>
+<div>{{.Pages}} pages, {{.Bytes}} image bytes, median {{.Median}}</div>
+{{if not .Head}}<div><a href="/compare?a={{.HeadID}}&amp;b={{.ID}}">compare pages with keep</a></div>{{end}}
+<label><input type="radio" name="d{{.ID}}" value="keep"{{if eq .Decision "keep"}} checked{{end}}> keep</label>
+<label><input type="radio" name="d{{.ID}}" value="delete"{{if eq .Decision "delete"}} checked{{end}}> delete</label>
+<label><input type="radio" name="d{{.ID}}" value="notdup"{{if eq .Decision "notdup"}} checked{{end}}> not duplicate</label>
+</div>
+{{end}}
+</div>
+<button type="submit">save</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+var uiCompareTemplate = template.Must(template.New("compare").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Kagami - compare pages</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table { border-collapse: collapse; font-size: 12px; }
+td, th { border: 1px solid #ccc; padding: .3em; vertical-align: top; word-break: break-all; }
+td.page { width: 210px; }
+td.page img { width: 200px; display: block; background: #eee; }
+tr.only td { background: #fbeaea; }
+tr.resolution td { background: #fdf6e0; }
+</style>
+</head>
+<body>
+<p><a href="/">back</a></p>
+<h1>compare pages</h1>
+<div>A: ({{.A.Dev}}:{{.A.Inode}}) {{.A.Name}}, {{len .A.Images}} pages</div>
+<div>B: ({{.B.Dev}}:{{.B.Inode}}) {{.B.Name}}, {{len .B.Images}} pages</div>
+<p>matched {{.Matched}}, resolution differs {{.Resolution}}, only in A {{.OnlyA}}, only in B {{.OnlyB}}</p>
+<table>
+<tr><th>A</th><th>B</th><th></th></tr>
+{{$a := printf "%d:%d" .A.Dev .A.Inode}}{{$b := printf "%d:%d" .B.Dev .B.Inode}}
+{{range .Pairs}}
+<tr class="{{if not .Matched}}only{{else if .ResolutionDiffer}}resolution{{end}}">
+<td class="page">{{with .A}}<img loading="lazy" src="/page?id={{$a}}&amp;name={{.Name}}" alt="page">{{end}}
+{{if .A}}<div>{{.NA}}: {{.A.Name}}</div><div>{{.A.Width}}x{{.A.Height}} {{.A.Format}}</div>{{end}}</td>
+<td class="page">{{with .B}}<img loading="lazy" src="/page?id={{$b}}&amp;name={{.Name}}" alt="page">{{end}}
+{{if .B}}<div>{{.NB}}: {{.B.Name}}</div><div>{{.B.Width}}x{{.B.Height}} {{.B.Format}}</div>{{end}}</td>
+<td>{{if .Matched}}dist {{.Dist}}{{if .ResolutionDiffer}}, resolution differs{{end}}{{else if .A}}only in A{{else}}only in B{{end}}</td>
+</tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
@@ -0,0 +1,111 @@
+package core
+
+import "sort"
+
+// disjoint set for grouping duplicate archives
+
+// unionFind disjoint set of item positions
+type unionFind struct {
+	parent []int
+	rank   []int
+}
+
+func newUnionFind(n int) *unionFind {
+	uf := &unionFind{
+		parent: make([]int, n),
+		rank:   make([]int, n),
+	}
+	for i := range uf.parent {
+		uf.parent[i] = i
+	}
+	return uf
+}
+
+// Find set representative of x
+func (uf *unionFind) Find(x int) int {
+	for uf.parent[x] != x {
+		// path halving
+		uf.parent[x] = uf.parent[uf.parent[x]]
+		x = uf.parent[x]
+	}
+	return x
+}
+
+// Union merge sets of x and y
+func (uf *unionFind) Union(x, y int) {
+	rx, ry := uf.Find(x), uf.Find(y)
+	if rx == ry {
+		return
+	}
+	if uf.rank[rx] < uf.rank[ry] {
+		rx, ry = ry, rx
+	}
+	uf.parent[ry] = rx
+	if uf.rank[rx] == uf.rank[ry] {
+		uf.rank[rx]++
+	}
+}
+
+// Groups every set with more than one member.
+// members ascending, sets ordered by first member
+func (uf *unionFind) Groups() [][]int {
+	sets := map[int][]int{}
+	for i := range uf.parent {
+		r := uf.Find(i)
+		sets[r] = append(sets[r], i)
+	}
+
+	groups := [][]int{}
+	for _, set := range sets {
+		if len(set) > 1 {
+			groups = append(groups, set)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i][0] < groups[j][0]
+	})
+	return groups
+}
+
+// pairKey undirected pair key, smaller first
+func pairKey(a, b int) [2]int {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]int{a, b}
+}
+
+// completeLink split group into clusters where every member links to every other.
+// members are taken in ascending order, each joins the first cluster it fully links to.
+// clusters with one member are dropped
+func completeLink(group []int, links map[[2]int]bool) [][]int {
+	clusters := [][]int{}
+	for _, m := range group {
+		joined := false
+		for ci, cluster := range clusters {
+			all := true
+			for _, c := range cluster {
+				if !links[pairKey(m, c)] {
+					all = false
+					break
+				}
+			}
+			if all {
+				clusters[ci] = append(cluster, m)
+				joined = true
+				break
+			}
+		}
+		if !joined {
+			clusters = append(clusters, []int{m})
+		}
+	}
+
+	out := [][]int{}
+	for _, cluster := range clusters {
+		if len(cluster) > 1 {
+			out = append(out, cluster)
+		}
+	}
+	return out
+}
@@ -0,0 +1,78 @@
+package core
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// groupNames archive names of every group, head first
+func groupNames(groups DupArchives) [][]string {
+	names := [][]string{}
+	for _, dup := range groups {
+		group := []string{dup.Head.Name}
+		for _, d := range dup.Dups {
+			group = append(group, d.Name)
+		}
+		names = append(names, group)
+	}
+	return names
+}
+
+func TestFindDupIndependentOfInputOrder(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+
+	// noisy copies of a few page sets, so some archives match only transitively
+	sets := make([][]uint64, 4)
+	for i := range sets {
+		sets[i] = randomHashes(r, 12)
+	}
+	archives := Archives{}
+	for i := 0; i < 40; i++ {
+		pages := []uint64{}
+		for _, h := range sets[r.Intn(len(sets))][:8] {
+			pages = append(pages, flipBits(r, h, r.Intn(4)))
+		}
+		archive := testArchive(int64(i+1), pages)
+		archive.Name = fmt.Sprintf("/lib/%03d.cbz", i)
+		archives = append(archives, archive)
+	}
+
+	for _, group := range []string{GroupSingle, GroupComplete} {
+		setCheckOptions(CheckOptions{MaxImageDist: 3, MaxArchiveDiff: 10, HashAlgo: HashAverage, Grouping: group})
+
+		want := groupNames(findDup(archives))
+		if len(want) == 0 {
+			t.Fatalf("%s: no groups found, test data too far apart", group)
+		}
+		for n := 0; n < 10; n++ {
+			shuffled := append(Archives{}, archives...)
+			r.Shuffle(len(shuffled), func(i, j int) {
+				shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+			})
+
+			got := groupNames(findDup(shuffled))
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s: groups depend on input order\ngot  %v\nwant %v", group, got, want)
+			}
+		}
+	}
+}
+
+func TestCompleteLinkOnlyJoinsFullyLinkedMembers(t *testing.T) {
+	// 0-1-2 all linked, 3 links only to 2, 4 and 5 link to each other only
+	links := map[[2]int]bool{
+		pairKey(0, 1): true,
+		pairKey(0, 2): true,
+		pairKey(1, 2): true,
+		pairKey(2, 3): true,
+		pairKey(4, 5): true,
+	}
+
+	got := completeLink([]int{0, 1, 2, 3, 4, 5}, links)
+	want := [][]int{{0, 1, 2}, {4, 5}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("clusters %v, want %v", got, want)
+	}
+}
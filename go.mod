@@ -1,9 +1,26 @@
 module github.com/comomac/kagami
 
-go 1.14
+go 1.26.0
 
 require (
-	github.com/davecgh/go-spew v1.1.1
+	github.com/bodgit/sevenzip v1.5.2
 	github.com/ninja-software/terror v0.0.2
-	golang.org/x/image v0.0.0-20200618115811-c13761719519
+	github.com/nwaples/rardecode/v2 v2.4.1
+	github.com/ulikunitz/xz v0.5.12
+	go.etcd.io/bbolt v1.3.9
+	golang.org/x/image v0.46.0
+)
+
+require (
+	github.com/andybalholm/brotli v1.1.0 // indirect
+	github.com/bodgit/plumbing v1.3.0 // indirect
+	github.com/bodgit/windows v1.0.1 // indirect
+	github.com/hashicorp/errwrap v1.0.0 // indirect
+	github.com/hashicorp/go-multierror v1.1.1 // indirect
+	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/pierrec/lz4/v4 v4.1.21 // indirect
+	go4.org v0.0.0-20200411211856-f5505b9728dd // indirect
+	golang.org/x/sys v0.48.0 // indirect
+	golang.org/x/text v0.42.0 // indirect
 )
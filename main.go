@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/comomac/kagami/client"
 	"github.com/comomac/kagami/core"
@@ -12,63 +18,109 @@ import (
 	"github.com/ninja-software/terror"
 )
 
+// exitInterrupted exit status of a scan interrupted by signal, as shells report SIGINT
+const exitInterrupted = 130
+
 func main() {
-	mode := flag.String("mode", "help", "mode to run. server, client, local, check")
-	hostIP := flag.String("hostIP", "", "server ip to host from or connect ip (server/client)")
-	dirPtr := flag.String("scanDir", ".", "dir to scan")
+	mode := flag.String("mode", "help", "mode to run. server, client, local, check, rm, restore, ui, compare, migrate, gc")
+	hostIP := flag.String("hostIP", "", "server ip to host from or connect ip (server/client/ui)")
+	dirPtr := flag.String("scanDir", ".", "comma separated dirs to scan, sharing one store")
+	storeDirPtr := flag.String("storeDir", "", "image sum store dir, store inside the first scanDir if empty")
 	maxIDist := flag.Int("maxIDist", 3, "maximum image distance. 0-64")
 	maxADiff := flag.Int("maxADiff", 10, "maximum archive difference")
 	exactMatch := flag.Bool("exactMatch", false, "match using exact match")
+	dryRun := flag.Bool("dryRun", false, "list what would change without changing store or files (gc/rm)")
+	memBudget := flag.Int64("memBudget", core.DefaultMemBudget>>20, "MB of page data read ahead of hashing (server/local)")
+	inFlight := flag.Int("inFlight", 0, "archives hashed at once, number of cpus if 0 (server/local)")
+	force := flag.Bool("force", false, "rehash archives even if unchanged (server/local)")
+	imageDirs := flag.Bool("imageDirs", false, "treat leaf directory of images as an archive (server/local)")
+	group := flag.String("group", core.GroupSingle, "duplicate grouping. single: transitive, complete: every member matches each other (check/rm, rm requires complete)")
+	quarantine := flag.String("quarantine", "", "dir to move duplicate archives into, outside of scanDir (rm/restore)")
+	run := flag.String("run", "", "rm run id to restore, last run if empty (restore)")
+	restoreGroup := flag.Int("restoreGroup", 0, "dup group number to restore, all groups if 0 (restore)")
+	keep := flag.String("keep", "", "comma separated keep rules to pick the archive kept in each group. pages, resolution, bytes, png, newest, path:<regexp> (check/rm)")
+	archiveA := flag.String("a", "", "first archive to compare, device:inode, inode or path (compare)")
+	archiveB := flag.String("b", "", "second archive to compare, device:inode, inode or path (compare)")
+	format := flag.String("format", core.FormatText, "check result format. text, json, csv (check)")
+	hashPtr := flag.String("hash", core.HashAverage, "comma separated image hash algorithms. ahash, dhash, phash, whash")
 
 	flag.Parse()
 
+	hashAlgos, err := core.ParseHashAlgos(*hashPtr)
+	if err != nil {
+		fmt.Printf("invalid hash. valid %s\n", strings.Join(core.HashAlgoNames(), ", "))
+		return
+	}
+
+	scanDirs := []string{}
+	for _, dir := range strings.Split(*dirPtr, ",") {
+		dir = strings.TrimSpace(dir)
+		if dir != "" {
+			scanDirs = append(scanDirs, dir)
+		}
+	}
+	storeDir := *storeDirPtr
+	if storeDir == "" && len(scanDirs) > 0 {
+		storeDir = filepath.Join(scanDirs[0], "store")
+	}
+
+	scanOpts := core.ScanOptions{
+		ImageDirs: *imageDirs,
+		HashAlgos: hashAlgos,
+		StoreDir:  storeDir,
+		Force:     *force,
+		MemBudget: *memBudget << 20,
+		InFlight:  *inFlight,
+	}
+
 	switch *mode {
 	case "local":
 		// local mode
 		fmt.Println("mode: local")
 
-		if *dirPtr == "" {
+		if len(scanDirs) == 0 {
 			fmt.Println("scanDir must be specified")
 			return
 		}
 
-		// create store dir for inode data
-		err := os.Mkdir(*dirPtr+"/store", 0755)
-		if err != nil && !os.IsExist(err) {
-			terror.Echo(err)
-			return
-		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
 
 		// list by files
-		// core.ListDir(*dirPtr)
+		// core.ListDir(ctx, scanDirs, scanOpts)
 
 		// list by images
 		q := core.Queue{}
-		err = core.ListDirByQueue(*dirPtr, &q, false)
+		err = core.ListDirByQueue(ctx, scanDirs, &q, false, scanOpts)
+		if errors.Is(err, context.Canceled) {
+			// checkpoint is saved, tell scripts the scan is partial
+			stop()
+			os.Exit(exitInterrupted)
+		}
 		if err != nil {
 			terror.Echo(err)
 			return
 		}
-
-		fmt.Println("DONE")
 		return
 
 	case "server":
 		// server mode
 		fmt.Println("mode: server")
 
-		if *dirPtr == "" {
+		if len(scanDirs) == 0 {
 			fmt.Println("scanDir must be specified")
 			return
 		}
 
-		// create store dir for inode data
-		err := os.Mkdir(*dirPtr+"/store", 0755)
-		if err != nil && !os.IsExist(err) {
-			log.Fatal(err)
-		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
 
-		err = server.Serve(*hostIP, *dirPtr)
+		err = server.Serve(ctx, *hostIP, scanDirs, scanOpts)
+		if errors.Is(err, context.Canceled) {
+			// checkpoint is saved, tell scripts the scan is partial
+			stop()
+			os.Exit(exitInterrupted)
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -77,15 +129,19 @@ func main() {
 		// client mode
 		fmt.Println("mode: client")
 
-		err := client.Connect(*hostIP)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		err = client.Connect(ctx, *hostIP)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-	case "check":
-		// check and find duplicate
+	case "check", "rm", "ui", "compare":
+		// check and find duplicate, rm also moves duplicates to quarantine, ui serves them for review,
+		// compare aligns pages of two archives
 
-		if *dirPtr == "" {
+		if len(scanDirs) == 0 {
 			fmt.Println("scanDir must be specified")
 			return
 		}
@@ -99,9 +155,94 @@ func main() {
 			fmt.Println("invalid maxADiff. valid >0")
 			return
 		}
-		fmt.Printf("maxIDist: %d  maxADiff: %d  exactMatch: %t\n", *maxIDist, *maxADiff, *exactMatch)
 
-		err := core.FindDup(*dirPtr+"/store", *maxIDist, *maxADiff, *exactMatch)
+		if *group != core.GroupSingle && *group != core.GroupComplete {
+			fmt.Println("invalid group. valid single, complete")
+			return
+		}
+
+		if *format != core.FormatText && *format != core.FormatJSON && *format != core.FormatCSV {
+			fmt.Println("invalid format. valid text, json, csv")
+			return
+		}
+
+		keepPolicy, err := core.ParseKeepPolicy(*keep)
+		if err != nil {
+			fmt.Println("invalid keep.", err)
+			return
+		}
+
+		// first hash to compare, second hash must agree
+		if len(hashAlgos) > 2 {
+			fmt.Println("invalid hash. check uses at most 2 hashes")
+			return
+		}
+		checkOpts := core.CheckOptions{
+			MaxImageDist:   *maxIDist,
+			MaxArchiveDiff: *maxADiff,
+			ExactMatch:     *exactMatch,
+			HashAlgo:       hashAlgos[0],
+			Grouping:       *group,
+			KeepPolicy:     keepPolicy,
+		}
+		if *mode == "check" {
+			checkOpts.Format = *format
+		}
+		if len(hashAlgos) > 1 {
+			checkOpts.AgreeHashAlgo = hashAlgos[1]
+		}
+		fmt.Fprintf(checkOpts.StatusOut(), "maxIDist: %d  maxADiff: %d  exactMatch: %t  hash: %s  group: %s\n", *maxIDist, *maxADiff, *exactMatch, strings.Join(hashAlgos, ","), *group)
+
+		switch *mode {
+		case "rm":
+			err = core.RmDup(scanDirs, storeDir, *quarantine, *dryRun, checkOpts)
+		case "ui":
+			err = core.HostUI(storeDir, *hostIP, checkOpts)
+		case "compare":
+			if *archiveA == "" || *archiveB == "" {
+				fmt.Println("a and b must be specified")
+				return
+			}
+			err = core.CompareArchives(storeDir, *archiveA, *archiveB, checkOpts)
+		default:
+			err = core.FindDup(storeDir, checkOpts)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	case "restore":
+		// move quarantined archives back
+		if *quarantine == "" {
+			fmt.Println("quarantine must be specified")
+			return
+		}
+
+		err = core.Restore(*quarantine, *run, *restoreGroup)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	case "migrate":
+		// import text image sum records into the store
+		if len(scanDirs) == 0 {
+			fmt.Println("scanDir must be specified")
+			return
+		}
+
+		err = core.MigrateStore(storeDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	case "gc":
+		// prune or relink store records of archives that no longer exist
+		if len(scanDirs) == 0 {
+			fmt.Println("scanDir must be specified")
+			return
+		}
+
+		err = core.GC(scanDirs, *dryRun, scanOpts)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -120,8 +261,39 @@ modes:
   client - receive images and calculate image sums
   local - calculate image sums locally
   check - find archives with duplicate images
+  rm - find archives with duplicate images and move all but the head of each group to quarantine, requires group complete.
+       archives reviewed keep or notdup in ui are left in place
+  restore - move archives of an rm run back from quarantine
+  ui - serve web page at port 4123 to review duplicate groups, decisions are saved in store
+  migrate - import image sum text records (store/<inode>.txt) of older versions into the store file
+  gc - prune store records of archives that no longer exist, relinking archives renamed within scanDir
+  compare - align pages of two archives, showing matched pages with distance, pages only in either archive and resolution differences
 
 parameters:
-  scanDir - directory to scan archives
-  hostIP - server/client use. server: ip for server to host from. client: server ip to connect to`)
+  scanDir - directory to scan archives, comma separated for several directories sharing one store
+  storeDir - image sum store directory, store inside the first scanDir if empty
+  hostIP - server/client/ui use. server/ui: ip to host from. client: server ip to connect to
+  imageDirs - server/local use. treat leaf directory of images as an archive
+  memBudget - server/local use. MB of page data read ahead of hashing, pages are streamed in as earlier pages are hashed.
+              a single page larger than the budget is still read
+  inFlight - server/local use. archives whose pages are queued for hashing at once, number of cpus if 0.
+             each archive is saved as soon as its pages are hashed
+  force - server/local use. rehash every archive, otherwise archives stored with the same size and modified time
+          are skipped and archives with a stored content fingerprint are linked
+  hash - comma separated image hash algorithms. ahash: average hash, dhash: difference hash, phash: dct perceptual hash, whash: wavelet hash
+         server/local: hashes to store per image. check: compare by first hash, second hash must also match
+  quarantine - rm/restore use. dir to move duplicate archives into, keeping path relative to scanDir,
+               under the scanDir name when there are several. journal is kept inside
+  dryRun - gc/rm use. gc: list what would be relinked or pruned without changing the store.
+           rm: list what would be moved to quarantine without moving anything
+  run - restore use. rm run id to restore, last run if empty
+  restoreGroup - restore use. dup group number of the run to restore, all groups if 0
+  keep - check/rm use. comma separated rules picking the archive to keep in each group, later rules break ties
+         pages: most pages, resolution: highest median resolution, bytes: largest total bytes
+         png: most png pages, newest: newest modified time, path:<regexp>: path matches pattern
+         first archive by path if empty
+  a, b - compare use. the two archives to compare, by device:inode, inode or path
+  format - check use. text: readable groups, json: groups with members, scores and matched page pairs, csv: one row per archive
+  group - check/rm use. single: group archives transitively, complete: every archive in group matches each other.
+          rm requires complete, so no archive is moved that does not match the kept head`)
 }
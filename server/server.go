@@ -1,19 +1,21 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	_ "image/gif"
 	_ "image/jpeg"
 	"net"
 	"net/rpc"
-	"os"
+	"sync"
 
 	"github.com/comomac/kagami/core"
 )
 
-// Listener RPC interface
+// Listener RPC interface, one per client connection
 type Listener struct {
 	Queue *core.Queue
+	owner uint64 // client owner id in queue
 }
 
 // GetLine test code for RPC
@@ -23,40 +25,65 @@ func (l *Listener) GetLine(line []byte, ack *int) error {
 	return nil
 }
 
-// GetZipImage get the next ZipImage data for RPC
+// GetZipImage get the next ZipImage data for RPC, waiting until one is queued
 func (l *Listener) GetZipImage(n int, ack *core.ZipImage) error {
-	zi := l.Queue.GetNext()
-	if zi != nil {
-		*ack = *zi
-	}
+	*ack = *l.Queue.GetNext(l.owner)
 	return nil
 }
 
 // SetZipImage set the ZipImage data for RPC
 func (l *Listener) SetZipImage(zImg core.ZipImage, ack *int) error {
-	// fmt.Printf("set! %3d %016X %s\n", zImg.Nth, zImg.PHash, zImg.Name)
-	l.Queue.Set(zImg.Nth, &zImg)
+	// fmt.Printf("set! %3d %v %s\n", zImg.Nth, zImg.Hashes, zImg.Name)
+	err := l.Queue.Set(l.owner, &zImg)
+	if err != nil {
+		return err
+	}
 	*ack = 1
 	return nil
 }
 
-// Serve initialise RCP service
-func Serve(listenIP, dir string) error {
-	if listenIP == "" {
-		listenIP = "localhost"
+// clientConn client connection, calls gone once reading fails as the client has disconnected
+type clientConn struct {
+	net.Conn
+	once sync.Once
+	gone func()
+}
+
+func (c *clientConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		c.once.Do(c.gone)
 	}
-	if dir == "" {
-		return fmt.Errorf("scanDir must be specified")
+	return n, err
+}
+
+// serveClient serve rpc to client connection, pages lent to the client are requeued once it disconnects
+func serveClient(conn net.Conn, q *core.Queue, owner uint64) {
+	server := rpc.NewServer()
+	err := server.Register(&Listener{Queue: q, owner: owner})
+	if err != nil {
+		fmt.Println("err register", err)
+		conn.Close()
+		return
 	}
 
-	// create store dir for inode data
-	err := os.Mkdir("store", 0755)
-	if err != nil && !os.IsExist(err) {
-		return err
+	release := func() {
+		q.Release(owner)
 	}
+	// calls still waiting for a page keep ServeConn running after disconnect, release on read error
+	server.ServeConn(&clientConn{Conn: conn, gone: release})
+	release()
+}
 
-	q := core.Queue{}
-	go core.ListDirByQueue(dir, &q, true)
+// Serve initialise RCP service, scanning every dir into one store.
+// returns once the scan is finished or cancelled
+func Serve(ctx context.Context, listenIP string, dirs []string, opts core.ScanOptions) error {
+	if listenIP == "" {
+		listenIP = "localhost"
+	}
+	if len(dirs) == 0 {
+		return fmt.Errorf("scanDir must be specified")
+	}
 
 	listen := listenIP + ":" + core.RPCPort
 	fmt.Println("listening", listen)
@@ -70,10 +97,24 @@ func Serve(listenIP, dir string) error {
 		return err
 	}
 
-	listener := new(Listener)
-	listener.Queue = &q
-	rpc.Register(listener)
-	rpc.Accept(inbound)
+	q := core.Queue{}
 
-	return nil
+	// stop accepting clients once the scan ends
+	done := make(chan error, 1)
+	go func() {
+		done <- core.ListDirByQueue(ctx, dirs, &q, true, opts)
+		inbound.Close()
+	}()
+
+	owner := uint64(0)
+	for {
+		conn, err := inbound.Accept()
+		if err != nil {
+			break
+		}
+		owner++
+		go serveClient(conn, &q, owner)
+	}
+
+	return <-done
 }
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"github.com/comomac/kagami/core"
+)
+
+func TestServeClientReleasesOnDisconnect(t *testing.T) {
+	q := &core.Queue{}
+	serverConn, clientConn := net.Pipe()
+
+	served := make(chan struct{})
+	go func() {
+		serveClient(serverConn, q, 1)
+		close(served)
+	}()
+
+	// call waiting for a page while the client disconnects
+	client := rpc.NewClient(clientConn)
+	call := client.Go("Listener.GetZipImage", 0, &core.ZipImage{}, nil)
+	time.Sleep(50 * time.Millisecond)
+	client.Close()
+
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("client connection still served after disconnect")
+	}
+	<-call.Done
+
+	if zi := q.GetNext(1); zi.Inode != -1 {
+		t.Error("page lent to disconnected client")
+	}
+}